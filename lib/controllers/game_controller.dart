@@ -1,8 +1,8 @@
 import 'dart:async';
 import 'dart:convert';
-import 'dart:math';
 
 import 'package:flutter/foundation.dart';
+import 'package:http/http.dart' as http;
 import 'package:shared_preferences/shared_preferences.dart';
 import 'package:web_socket_channel/web_socket_channel.dart';
 
@@ -17,6 +17,7 @@ class GameController extends ChangeNotifier {
   GameState? state;
   String? roomCode;
   String? playerId;
+  String? reconnectToken;
   String? symbol;
   String? role;
   String? errorMessage;
@@ -26,8 +27,7 @@ class GameController extends ChangeNotifier {
   WebSocketChannel? _channel;
   StreamSubscription? _subscription;
   bool _manualClose = false;
-  String? _guestId;
-  final Random _random = Random.secure();
+  String? _guestToken;
 
   bool get isConnected => connectionStatus == ConnectionStatus.connected;
   bool get isSpectator => role == 'spectator';
@@ -37,10 +37,10 @@ class GameController extends ChangeNotifier {
     roomClosedReason = null;
     errorMessage = null;
     await _ensureConnected();
-    final guestId = await _ensureGuestId();
+    final guestToken = await _ensureGuestToken();
     _send('create_room', {
       'name': name,
-      'guest_id': guestId,
+      'guest_id': guestToken,
     });
   }
 
@@ -49,12 +49,12 @@ class GameController extends ChangeNotifier {
     roomClosedReason = null;
     errorMessage = null;
     await _ensureConnected();
-    final guestId = await _ensureGuestId();
+    final guestToken = await _ensureGuestToken();
     _send('join_room', {
       'room_code': code.toUpperCase(),
       'name': name,
       'spectator': spectator,
-      'guest_id': guestId,
+      'guest_id': guestToken,
     });
   }
 
@@ -68,12 +68,13 @@ class GameController extends ChangeNotifier {
     roomClosedReason = null;
     errorMessage = null;
     await _ensureConnected(force: true);
-    final guestId = await _ensureGuestId();
+    final guestToken = await _ensureGuestToken();
     _send('join_room', {
       'room_code': roomCode,
       'player_id': playerId,
+      if (reconnectToken != null) 'reconnect_token': reconnectToken,
       'spectator': isSpectator,
-      'guest_id': guestId,
+      'guest_id': guestToken,
     });
   }
 
@@ -89,7 +90,6 @@ class GameController extends ChangeNotifier {
     }
     _send('move', {
       'room_code': roomCode,
-      'player_id': playerId,
       'cell': cell,
     });
   }
@@ -99,6 +99,7 @@ class GameController extends ChangeNotifier {
     _closeChannel();
     roomCode = null;
     playerId = null;
+    reconnectToken = null;
     symbol = null;
     role = null;
     state = null;
@@ -123,21 +124,54 @@ class GameController extends ChangeNotifier {
     await _connect();
   }
 
-  Future<String> _ensureGuestId() async {
-    if (_guestId != null) {
-      return _guestId!;
+  // The server signs guest identities. A raw id saved by an older version of
+  // the app is sent once so the guest keeps their history.
+  Future<String?> _ensureGuestToken() async {
+    if (_guestToken != null) {
+      return _guestToken;
     }
     final prefs = await SharedPreferences.getInstance();
-    final stored = prefs.getString('ttt_guest_id');
+    final stored = prefs.getString('ttt_guest_token');
     if (stored != null && stored.isNotEmpty) {
-      _guestId = stored;
+      _guestToken = stored;
       return stored;
     }
-    final bytes = List<int>.generate(16, (_) => _random.nextInt(256));
-    final generated = base64UrlEncode(bytes);
-    await prefs.setString('ttt_guest_id', generated);
-    _guestId = generated;
-    return generated;
+    try {
+      final legacyGuestId = prefs.getString('ttt_guest_id');
+      var response = await _requestGuestToken(legacyGuestId);
+      if (response.statusCode == 409) {
+        response = await _requestGuestToken(null);
+      }
+      if (response.statusCode < 200 || response.statusCode >= 300) {
+        return null;
+      }
+      final data = jsonDecode(response.body) as Map<String, dynamic>;
+      final token = data['guest_token'] as String?;
+      if (token == null || token.isEmpty) {
+        return null;
+      }
+      await prefs.setString('ttt_guest_token', token);
+      await prefs.remove('ttt_guest_id');
+      _guestToken = token;
+      return token;
+    } catch (_) {
+      return null;
+    }
+  }
+
+  Future<http.Response> _requestGuestToken(String? legacyGuestId) {
+    final uri = Uri.parse(serverUrl);
+    final api = Uri(
+      scheme: uri.scheme == 'wss' ? 'https' : 'http',
+      host: uri.host,
+      port: uri.hasPort ? uri.port : null,
+      path: '/auth/guest',
+    );
+    return http.post(
+      api,
+      headers: const {'Content-Type': 'application/json'},
+      body: jsonEncode(legacyGuestId != null && legacyGuestId.isNotEmpty ? {'legacy_guest_id': legacyGuestId} : {}),
+    );
   }
 
   Future<void> _connect() async {
@@ -227,6 +261,7 @@ class GameController extends ChangeNotifier {
   void _applyRoomResponse(Map<String, dynamic> payload) {
     roomCode = payload['room_code'] as String? ?? roomCode;
     playerId = payload['player_id'] as String? ?? playerId;
+    reconnectToken = payload['reconnect_token'] as String? ?? reconnectToken;
     final incomingSymbol = payload['symbol'] as String?;
     if (incomingSymbol != null && incomingSymbol.isNotEmpty) {
       symbol = incomingSymbol;
@@ -258,7 +293,6 @@ class GameController extends ChangeNotifier {
     }
     _send('rematch', {
       'room_code': roomCode,
-      'player_id': playerId,
     });
   }
 
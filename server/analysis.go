@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+)
+
+type analyzeRequest struct {
+	Board  []string `json:"board"`
+	Turn   string   `json:"turn"`
+	Misere bool     `json:"misere,omitempty"`
+}
+
+type moveAnalysis struct {
+	Cell    int    `json:"cell"`
+	Outcome string `json:"outcome"`
+	Plies   int    `json:"plies"`
+	Best    bool   `json:"best"`
+}
+
+type analyzeResponse struct {
+	Turn    string         `json:"turn"`
+	Status  string         `json:"status"`
+	Winner  string         `json:"winner"`
+	Outcome string         `json:"outcome,omitempty"`
+	Plies   int            `json:"plies,omitempty"`
+	Moves   []moveAnalysis `json:"moves"`
+}
+
+func (s *Server) handleAnalyze(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req analyzeRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&req); err != nil {
+		http.Error(w, "invalid analyze payload", http.StatusBadRequest)
+		return
+	}
+
+	response, err := analyzePosition(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	writeJSON(w, response, http.StatusOK)
+}
+
+func analyzePosition(req analyzeRequest) (analyzeResponse, error) {
+	rules := defaultRules()
+	rules.Misere = req.Misere
+	if len(req.Board) != rules.cells() {
+		return analyzeResponse{}, errors.New("board must have 9 cells")
+	}
+
+	countX, countO := 0, 0
+	for _, cell := range req.Board {
+		switch cell {
+		case "":
+		case symbolX:
+			countX++
+		case symbolO:
+			countO++
+		default:
+			return analyzeResponse{}, errors.New("invalid cell value")
+		}
+	}
+
+	turn, err := resolveTurn(req.Turn, countX, countO)
+	if err != nil {
+		return analyzeResponse{}, err
+	}
+
+	position := &Room{rules: rules, board: req.Board}
+	response := analyzeResponse{Turn: turn, Status: statusInProgress, Moves: []moveAnalysis{}}
+	if winner := position.checkWinner(); winner != "" {
+		response.Status = statusWin
+		response.Winner = winner
+		return response, nil
+	}
+	if position.checkDraw() {
+		response.Status = statusDraw
+		return response, nil
+	}
+
+	sv := newSolver(rules)
+	best := sv.solve(req.Board, turn)
+	response.Outcome = outcomeLabel(best.Outcome)
+	response.Plies = best.Plies
+	for cell, value := range req.Board {
+		if value != "" {
+			continue
+		}
+		result := sv.evaluateMove(req.Board, turn, cell)
+		response.Moves = append(response.Moves, moveAnalysis{
+			Cell:    cell,
+			Outcome: outcomeLabel(result.Outcome),
+			Plies:   result.Plies,
+			Best:    result.score() == best.score(),
+		})
+	}
+	return response, nil
+}
+
+// resolveTurn infers the side to move from the piece counts; either side may
+// have started since rematches alternate the starting symbol.
+func resolveTurn(requested string, countX, countO int) (string, error) {
+	var expected string
+	switch countX - countO {
+	case 0:
+		expected = requested
+		if expected == "" {
+			expected = symbolX
+		}
+	case 1:
+		expected = symbolO
+	case -1:
+		expected = symbolX
+	default:
+		return "", errors.New("impossible position")
+	}
+
+	if expected != symbolX && expected != symbolO {
+		return "", errors.New("invalid turn")
+	}
+	if requested != "" && requested != expected {
+		return "", errors.New("turn does not match board")
+	}
+	return expected, nil
+}
+
+func outcomeLabel(outcome int) string {
+	switch outcome {
+	case outcomeWin:
+		return "win"
+	case outcomeLoss:
+		return "loss"
+	default:
+		return "draw"
+	}
+}
@@ -10,24 +10,18 @@ import (
 	"io"
 	"log"
 	"net/http"
-	"net/url"
-	"os"
 	"strings"
 	"time"
 )
 
-type discordConfig struct {
-	ClientID     string
-	ClientSecret string
-	RedirectURI  string
-}
-
 type User struct {
 	ID        int64  `json:"id"`
 	DiscordID string `json:"discord_id,omitempty"`
 	Username  string `json:"username"`
 	Avatar    string `json:"avatar,omitempty"`
 	IsGuest   bool   `json:"is_guest"`
+
+	Identities []identity `json:"identities,omitempty"`
 }
 
 type authResponse struct {
@@ -42,126 +36,6 @@ type wsTicketResponse struct {
 	ExpiresIn int64  `json:"expires_in"`
 }
 
-type discordTokenResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int64  `json:"expires_in"`
-	Scope       string `json:"scope"`
-}
-
-type discordUser struct {
-	ID         string `json:"id"`
-	Username   string `json:"username"`
-	GlobalName string `json:"global_name"`
-	Avatar     string `json:"avatar"`
-}
-
-func loadDiscordConfig() (discordConfig, error) {
-	config := discordConfig{
-		ClientID:     strings.TrimSpace(os.Getenv("DISCORD_CLIENT_ID")),
-		ClientSecret: strings.TrimSpace(os.Getenv("DISCORD_CLIENT_SECRET")),
-		RedirectURI:  strings.TrimSpace(os.Getenv("DISCORD_REDIRECT_URL")),
-	}
-	if config.ClientID == "" || config.ClientSecret == "" || config.RedirectURI == "" {
-		return config, errors.New("discord oauth not configured")
-	}
-	return config, nil
-}
-
-func (s *Server) handleDiscordLogin(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-	if s.discord.ClientID == "" {
-		http.Error(w, "discord oauth not configured", http.StatusServiceUnavailable)
-		return
-	}
-
-	state := randomToken(18)
-	setCookie(w, "oauth_state", state, 10*time.Minute, true, r)
-
-	guestID := normalizeGuestID(r.URL.Query().Get("guest_id"))
-	if guestID != "" {
-		setCookie(w, "guest_id", guestID, 10*time.Minute, true, r)
-	}
-
-	returnTo := sanitizeReturnTo(r.URL.Query().Get("return_to"))
-	if returnTo != "" {
-		setCookie(w, "post_login_redirect", returnTo, 10*time.Minute, true, r)
-	}
-
-	authURL := buildDiscordAuthURL(s.discord, state)
-	http.Redirect(w, r, authURL, http.StatusFound)
-}
-
-func (s *Server) handleDiscordCallback(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodGet {
-		w.WriteHeader(http.StatusMethodNotAllowed)
-		return
-	}
-	if s.discord.ClientID == "" {
-		http.Error(w, "discord oauth not configured", http.StatusServiceUnavailable)
-		return
-	}
-	state := r.URL.Query().Get("state")
-	code := r.URL.Query().Get("code")
-	if state == "" || code == "" {
-		http.Error(w, "invalid oauth response", http.StatusBadRequest)
-		return
-	}
-
-	if !matchesCookie(r, "oauth_state", state) {
-		http.Error(w, "invalid oauth state", http.StatusUnauthorized)
-		return
-	}
-
-	token, err := exchangeDiscordCode(s.discord, code)
-	if err != nil {
-		log.Printf("discord token exchange failed: %v", err)
-		http.Error(w, "oauth exchange failed", http.StatusBadGateway)
-		return
-	}
-
-	user, err := fetchDiscordUser(token.AccessToken)
-	if err != nil {
-		log.Printf("discord user fetch failed: %v", err)
-		http.Error(w, "oauth user fetch failed", http.StatusBadGateway)
-		return
-	}
-
-	guestID := ""
-	if cookie, err := r.Cookie("guest_id"); err == nil {
-		guestID = normalizeGuestID(cookie.Value)
-	}
-
-	userID, _, err := s.upsertDiscordUser(user, guestID)
-	if err != nil {
-		log.Printf("oauth user store failed: %v", err)
-		http.Error(w, "oauth user store failed", http.StatusInternalServerError)
-		return
-	}
-
-	_, refreshToken, _, refreshExp, err := s.createSession(userID)
-	if err != nil {
-		log.Printf("oauth session create failed: %v", err)
-		http.Error(w, "oauth session failed", http.StatusInternalServerError)
-		return
-	}
-
-	setRefreshCookie(w, refreshToken, refreshExp, r)
-	clearCookie(w, "oauth_state")
-	clearCookie(w, "guest_id")
-
-	redirectPath := "/"
-	if cookie, err := r.Cookie("post_login_redirect"); err == nil {
-		redirectPath = sanitizeReturnTo(cookie.Value)
-	}
-	clearCookie(w, "post_login_redirect")
-
-	http.Redirect(w, r, redirectPath, http.StatusFound)
-}
-
 func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -174,13 +48,14 @@ func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sessionID, user, err := s.sessionFromRefreshToken(refreshToken)
-	if err != nil {
-		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+	user, tokens, err := s.refreshSession(refreshToken)
+	if errors.Is(err, errInvalidRefresh) || errors.Is(err, errRefreshReused) {
+		if fromCookie {
+			clearCookie(w, "refresh_token")
+		}
+		http.Error(w, err.Error(), http.StatusUnauthorized)
 		return
 	}
-
-	accessToken, newRefresh, accessExp, refreshExp, err := s.rotateSession(sessionID)
 	if err != nil {
 		log.Printf("session rotate failed: %v", err)
 		http.Error(w, "session rotate failed", http.StatusInternalServerError)
@@ -189,13 +64,13 @@ func (s *Server) handleRefresh(w http.ResponseWriter, r *http.Request) {
 
 	response := authResponse{
 		User:        user,
-		AccessToken: accessToken,
-		ExpiresIn:   accessExp - nowUnix(),
+		AccessToken: tokens.AccessToken,
+		ExpiresIn:   tokens.AccessExp - nowUnix(),
 	}
 	if fromCookie {
-		setRefreshCookie(w, newRefresh, refreshExp, r)
+		setRefreshCookie(w, tokens.RefreshToken, tokens.RefreshExp, r)
 	} else {
-		response.RefreshToken = newRefresh
+		response.RefreshToken = tokens.RefreshToken
 	}
 
 	writeJSON(w, response, http.StatusOK)
@@ -207,6 +82,11 @@ func (s *Server) handleMe(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "unauthorized", http.StatusUnauthorized)
 		return
 	}
+	if user.Identities, err = s.loadIdentities(user.ID); err != nil {
+		log.Printf("identities load failed: %v", err)
+		http.Error(w, "me failed", http.StatusInternalServerError)
+		return
+	}
 	writeJSON(w, user, http.StatusOK)
 }
 
@@ -258,14 +138,20 @@ func (s *Server) handleHistory(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	items, err := s.loadHistory(user.ID, 50)
+	filter, err := parseHistoryFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page, err := s.loadHistory(user.ID, filter)
 	if err != nil {
 		log.Printf("history load failed: %v", err)
 		http.Error(w, "history failed", http.StatusInternalServerError)
 		return
 	}
 
-	writeJSON(w, items, http.StatusOK)
+	writeJSON(w, page, http.StatusOK)
 }
 
 func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
@@ -275,78 +161,20 @@ func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	stats, err := s.loadStats(user.ID)
+	window, err := parseStatsRange(r.URL.Query().Get("range"))
 	if err != nil {
-		log.Printf("stats load failed: %v", err)
-		http.Error(w, "stats failed", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	writeJSON(w, stats, http.StatusOK)
-}
-
-func exchangeDiscordCode(config discordConfig, code string) (discordTokenResponse, error) {
-	data := url.Values{}
-	data.Set("client_id", config.ClientID)
-	data.Set("client_secret", config.ClientSecret)
-	data.Set("grant_type", "authorization_code")
-	data.Set("code", code)
-	data.Set("redirect_uri", config.RedirectURI)
-
-	req, err := http.NewRequest(http.MethodPost, "https://discord.com/api/v10/oauth2/token", strings.NewReader(data.Encode()))
+	stats, err := s.loadStats(user.ID, window)
 	if err != nil {
-		return discordTokenResponse{}, err
-	}
-	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
-	client := &http.Client{Timeout: 10 * time.Second}
-	resp, err := client.Do(req)
-	if err != nil {
-		return discordTokenResponse{}, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(resp.Body)
-		return discordTokenResponse{}, fmt.Errorf("discord token error: %s", string(body))
-	}
-	var token discordTokenResponse
-	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
-		return discordTokenResponse{}, err
+		log.Printf("stats load failed: %v", err)
+		http.Error(w, "stats failed", http.StatusInternalServerError)
+		return
 	}
-	return token, nil
-}
 
-func fetchDiscordUser(accessToken string) (discordUser, error) {
-	client := &http.Client{Timeout: 10 * time.Second}
-	req, err := http.NewRequest(http.MethodGet, "https://discord.com/api/v10/users/@me", nil)
-	if err != nil {
-		return discordUser{}, err
-	}
-	req.Header.Set("Authorization", "Bearer "+accessToken)
-	resp, err := client.Do(req)
-	if err != nil {
-		return discordUser{}, err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		body, _ := io.ReadAll(resp.Body)
-		return discordUser{}, fmt.Errorf("discord user error: %s", string(body))
-	}
-	var user discordUser
-	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
-		return discordUser{}, err
-	}
-	return user, nil
-}
-
-func buildDiscordAuthURL(config discordConfig, state string) string {
-	params := url.Values{}
-	params.Set("client_id", config.ClientID)
-	params.Set("redirect_uri", config.RedirectURI)
-	params.Set("response_type", "code")
-	params.Set("scope", "identify")
-	params.Set("state", state)
-	params.Set("prompt", "consent")
-	return "https://discord.com/oauth2/authorize?" + params.Encode()
+	writeJSON(w, stats, http.StatusOK)
 }
 
 func sanitizeReturnTo(raw string) string {
@@ -463,72 +291,10 @@ func writeJSON(w http.ResponseWriter, payload any, status int) {
 	_ = json.NewEncoder(w).Encode(payload)
 }
 
-func (s *Server) upsertDiscordUser(user discordUser, guestID string) (int64, User, error) {
-	displayName := strings.TrimSpace(user.GlobalName)
-	if displayName == "" {
-		displayName = strings.TrimSpace(user.Username)
-	}
-	avatarURL := ""
-	if user.Avatar != "" {
-		avatarURL = fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", user.ID, user.Avatar)
-	}
-
-	now := nowUnix()
-	var stored User
-	err := withTx(s.db, func(tx *sql.Tx) error {
-		var discordID int64
-		discordErr := tx.QueryRow("SELECT id FROM users WHERE discord_id = ?", user.ID).Scan(&discordID)
-		if discordErr != nil && discordErr != sql.ErrNoRows {
-			return discordErr
-		}
-
-		guestID = normalizeGuestID(guestID)
-		var guestUserID int64
-		guestErr := sql.ErrNoRows
-		if guestID != "" {
-			guestErr = tx.QueryRow("SELECT id FROM users WHERE guest_id = ?", guestID).Scan(&guestUserID)
-			if guestErr != nil && guestErr != sql.ErrNoRows {
-				return guestErr
-			}
-		}
-
-		if discordErr == nil {
-			if _, err := tx.Exec("UPDATE users SET username = ?, avatar = ?, is_guest = 0 WHERE id = ?", displayName, avatarURL, discordID); err != nil {
-				return err
-			}
-			if guestErr == nil && guestUserID != discordID {
-				if err := mergeUsers(tx, guestUserID, discordID); err != nil {
-					return err
-				}
-			}
-			stored = User{ID: discordID, DiscordID: user.ID, Username: displayName, Avatar: avatarURL, IsGuest: false}
-			return nil
-		}
-
-		if guestErr == nil {
-			if _, err := tx.Exec("UPDATE users SET discord_id = ?, username = ?, avatar = ?, is_guest = 0 WHERE id = ?", user.ID, displayName, avatarURL, guestUserID); err != nil {
-				return err
-			}
-			stored = User{ID: guestUserID, DiscordID: user.ID, Username: displayName, Avatar: avatarURL, IsGuest: false}
-			return nil
-		}
-
-		res, err := tx.Exec("INSERT INTO users (discord_id, username, avatar, is_guest, created_at) VALUES (?, ?, ?, 0, ?)", user.ID, displayName, avatarURL, now)
-		if err != nil {
-			return err
-		}
-		newID, err := res.LastInsertId()
-		if err != nil {
-			return err
-		}
-		stored = User{ID: newID, DiscordID: user.ID, Username: displayName, Avatar: avatarURL, IsGuest: false}
-		return nil
-	})
-	return stored.ID, stored, err
-}
-
-func (s *Server) ensureGuestUser(guestID, name string) (int64, error) {
-	guestID = normalizeGuestID(guestID)
+// ensureGuestUser maps a signed guest token to its user row, creating it on
+// first use. Raw guest ids are not accepted.
+func (s *Server) ensureGuestUser(guestToken, name string) (int64, error) {
+	guestID := s.guestIDFromToken(guestToken)
 	if guestID == "" {
 		return 0, nil
 	}
@@ -537,28 +303,29 @@ func (s *Server) ensureGuestUser(guestID, name string) (int64, error) {
 		name = "Invite"
 	}
 
+	now := nowUnix()
 	var userID int64
 	if err := s.db.QueryRow("SELECT id FROM users WHERE guest_id = ?", guestID).Scan(&userID); err == nil {
 		if name != "" {
-			_, _ = s.db.Exec("UPDATE users SET username = ? WHERE id = ?", name, userID)
+			_, _ = s.db.Exec("UPDATE users SET username = ?, last_seen_at = ? WHERE id = ?", name, now, userID)
 		}
 		return userID, nil
 	} else if err != sql.ErrNoRows {
 		return 0, err
 	}
 
-	res, err := s.db.Exec("INSERT INTO users (guest_id, username, is_guest, created_at) VALUES (?, ?, 1, ?)", guestID, name, nowUnix())
+	res, err := s.db.Exec("INSERT INTO users (guest_id, username, is_guest, created_at, guest_claimed_at, last_seen_at) VALUES (?, ?, 1, ?, ?, ?)", guestID, name, now, now, now)
 	if err != nil {
 		return 0, err
 	}
 	return res.LastInsertId()
 }
 
-func (s *Server) resolveUserID(sessionUserID *int64, guestID, name string) (int64, error) {
+func (s *Server) resolveUserID(sessionUserID *int64, guestToken, name string) (int64, error) {
 	if sessionUserID != nil && *sessionUserID != 0 {
 		return *sessionUserID, nil
 	}
-	return s.ensureGuestUser(guestID, name)
+	return s.ensureGuestUser(guestToken, name)
 }
 
 func (s *Server) createSession(userID int64) (string, string, int64, int64, error) {
@@ -587,7 +354,7 @@ func (s *Server) sessionFromRefreshToken(refreshToken string) (int64, User, erro
 		return 0, User{}, errors.New("missing token")
 	}
 	row := s.db.QueryRow(
-		`SELECT s.id, u.id, u.discord_id, u.username, u.avatar, u.is_guest, s.refresh_expires_at
+		`SELECT s.id, u.id, COALESCE((SELECT i.subject FROM identities i WHERE i.user_id = u.id AND i.provider = 'discord'), ''), u.username, u.avatar, u.is_guest, s.refresh_expires_at
 		 FROM sessions s
 		 JOIN users u ON u.id = s.user_id
 		 WHERE s.refresh_token_hash = ?`,
@@ -606,36 +373,23 @@ func (s *Server) sessionFromRefreshToken(refreshToken string) (int64, User, erro
 	return sessionID, User{ID: userID, DiscordID: discordID, Username: username, Avatar: avatar, IsGuest: isGuest == 1}, nil
 }
 
-func (s *Server) rotateSession(sessionID int64) (string, string, int64, int64, error) {
-	accessToken := randomToken(24)
-	refreshToken := randomToken(36)
-	accessExp := nowUnix() + int64(accessTokenTTL.Seconds())
-	refreshExp := nowUnix() + int64(refreshTokenTTL.Seconds())
-
-	_, err := s.db.Exec(
-		"UPDATE sessions SET access_token_hash = ?, access_expires_at = ?, refresh_token_hash = ?, refresh_expires_at = ? WHERE id = ?",
-		hashToken(accessToken),
-		accessExp,
-		hashToken(refreshToken),
-		refreshExp,
-		sessionID,
-	)
-	if err != nil {
-		return "", "", 0, 0, err
-	}
-	return accessToken, refreshToken, accessExp, refreshExp, nil
-}
-
 func (s *Server) userFromAccessToken(accessToken string) (User, error) {
 	if accessToken == "" {
 		return User{}, errors.New("missing token")
 	}
+	// Besides its own access token a session accepts the extra ones handed
+	// out by refreshes within the reuse grace window.
 	row := s.db.QueryRow(
-		`SELECT u.id, u.discord_id, u.username, u.avatar, u.is_guest, s.access_expires_at
-		 FROM sessions s
+		`SELECT u.id, COALESCE((SELECT i.subject FROM identities i WHERE i.user_id = u.id AND i.provider = 'discord'), ''), u.username, COALESCE(u.avatar, ''), u.is_guest, t.expires_at
+		 FROM (
+			SELECT id AS session_id, access_expires_at AS expires_at FROM sessions WHERE access_token_hash = ?
+			UNION ALL
+			SELECT session_id, expires_at FROM session_access_tokens WHERE token_hash = ?
+		 ) t
+		 JOIN sessions s ON s.id = t.session_id
 		 JOIN users u ON u.id = s.user_id
-		 WHERE s.access_token_hash = ?`,
-		hashToken(accessToken),
+		 LIMIT 1`,
+		hashToken(accessToken), hashToken(accessToken),
 	)
 	var user User
 	var expiresAt int64
@@ -654,7 +408,10 @@ func (s *Server) deleteSessionByAccessToken(token string) error {
 	if token == "" {
 		return nil
 	}
-	_, err := s.db.Exec("DELETE FROM sessions WHERE access_token_hash = ?", hashToken(token))
+	_, err := s.db.Exec(
+		"DELETE FROM sessions WHERE access_token_hash = ? OR id IN (SELECT session_id FROM session_access_tokens WHERE token_hash = ?)",
+		hashToken(token), hashToken(token),
+	)
 	return err
 }
 
@@ -713,18 +470,36 @@ func withTx(db *sql.DB, fn func(*sql.Tx) error) error {
 	return tx.Commit()
 }
 
+// mergeUsers moves everything fromID owns to toID and deletes fromID. Where
+// both have a row that can only exist once per user (a rating, a tournament
+// entry, a season standing) toID's row is kept.
 func mergeUsers(tx *sql.Tx, fromID, toID int64) error {
 	if fromID == 0 || toID == 0 || fromID == toID {
 		return nil
 	}
-	if _, err := tx.Exec("UPDATE games SET player_x_user_id = ? WHERE player_x_user_id = ?", toID, fromID); err != nil {
-		return err
-	}
-	if _, err := tx.Exec("UPDATE games SET player_o_user_id = ? WHERE player_o_user_id = ?", toID, fromID); err != nil {
-		return err
+	statements := []string{
+		"UPDATE games SET player_x_user_id = ? WHERE player_x_user_id = ?",
+		"UPDATE games SET player_o_user_id = ? WHERE player_o_user_id = ?",
+		"UPDATE games SET imported_by = ? WHERE imported_by = ?",
+		"UPDATE identities SET user_id = ? WHERE user_id = ?",
+		"UPDATE OR IGNORE ratings SET user_id = ? WHERE user_id = ?",
+		"UPDATE OR IGNORE rating_history SET user_id = ? WHERE user_id = ?",
+		"UPDATE OR IGNORE tournament_players SET user_id = ? WHERE user_id = ?",
+		"UPDATE tournament_matches SET player_x_user_id = ? WHERE player_x_user_id = ?",
+		"UPDATE tournament_matches SET player_o_user_id = ? WHERE player_o_user_id = ?",
+		"UPDATE tournament_matches SET winner_user_id = ? WHERE winner_user_id = ?",
+		"UPDATE tournaments SET created_by = ? WHERE created_by = ?",
+		"UPDATE OR IGNORE season_standings SET user_id = ? WHERE user_id = ?",
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement, toID, fromID); err != nil {
+			return err
+		}
 	}
-	if _, err := tx.Exec("DELETE FROM sessions WHERE user_id = ?", fromID); err != nil {
-		return err
+	for _, table := range []string{"ratings", "rating_history", "tournament_players", "season_standings", "sessions"} {
+		if _, err := tx.Exec("DELETE FROM "+table+" WHERE user_id = ?", fromID); err != nil {
+			return err
+		}
 	}
 	if _, err := tx.Exec("DELETE FROM users WHERE id = ?", fromID); err != nil {
 		return err
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+const (
+	variantClassic  = "classic"
+	variantUltimate = "ultimate"
+)
+
+const (
+	defaultBoardSize = 3
+	minBoardSize     = 3
+	maxBoardSize     = 15
+	minWinLength     = 3
+	defaultMaxWin    = 5
+)
+
+type gameRules struct {
+	Variant   string `json:"variant"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	WinLength int    `json:"win_length"`
+	Misere    bool   `json:"misere"`
+}
+
+var lineDirections = [][2]int{
+	{1, 0},
+	{0, 1},
+	{1, 1},
+	{1, -1},
+}
+
+func defaultRules() gameRules {
+	return gameRules{Variant: variantClassic, Width: defaultBoardSize, Height: defaultBoardSize, WinLength: defaultBoardSize}
+}
+
+func newGameRules(variant string, width, height, winLength int) (gameRules, error) {
+	switch variant {
+	case "", variantClassic:
+	case variantUltimate:
+		if (width != 0 && width != defaultBoardSize) || (height != 0 && height != defaultBoardSize) || (winLength != 0 && winLength != defaultBoardSize) {
+			return gameRules{}, errors.New("ultimate board size is fixed")
+		}
+		rules := defaultRules()
+		rules.Variant = variantUltimate
+		return rules, nil
+	default:
+		return gameRules{}, errors.New("unknown variant")
+	}
+
+	if width == 0 {
+		width = defaultBoardSize
+	}
+	if height == 0 {
+		height = width
+	}
+	if width < minBoardSize || width > maxBoardSize || height < minBoardSize || height > maxBoardSize {
+		return gameRules{}, fmt.Errorf("board size must be between %d and %d", minBoardSize, maxBoardSize)
+	}
+	if winLength == 0 {
+		winLength = min(width, height, defaultMaxWin)
+	}
+	if winLength < minWinLength || winLength > max(width, height) {
+		return gameRules{}, errors.New("invalid win length")
+	}
+	return gameRules{Variant: variantClassic, Width: width, Height: height, WinLength: winLength}, nil
+}
+
+func (g gameRules) cells() int {
+	if g.Variant == variantUltimate {
+		return ultimateBoards * ultimateCells
+	}
+	return g.Width * g.Height
+}
+
+// winnerFromLine maps the symbol that completed a line to the game winner:
+// the line-maker wins normally and loses under misère rules.
+func (g gameRules) winnerFromLine(line string) string {
+	if line == "" || !g.Misere {
+		return line
+	}
+	return otherSymbol(line)
+}
+
+func (g gameRules) newBoard() []string {
+	return make([]string, g.cells())
+}
+
+func findWinner(board []string, width, height, winLength int) string {
+	for row := 0; row < height; row++ {
+		for col := 0; col < width; col++ {
+			symbol := board[row*width+col]
+			if symbol == "" {
+				continue
+			}
+			for _, dir := range lineDirections {
+				endCol := col + dir[0]*(winLength-1)
+				endRow := row + dir[1]*(winLength-1)
+				if endCol < 0 || endCol >= width || endRow < 0 || endRow >= height {
+					continue
+				}
+				count := 1
+				for count < winLength && board[(row+dir[1]*count)*width+col+dir[0]*count] == symbol {
+					count++
+				}
+				if count == winLength {
+					return symbol
+				}
+			}
+		}
+	}
+	return ""
+}
+
+func boardFull(board []string) bool {
+	for _, cell := range board {
+		if cell == "" {
+			return false
+		}
+	}
+	return true
+}
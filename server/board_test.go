@@ -0,0 +1,130 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// parseBoard reads rows of "X", "O" and "." into a board slice.
+func parseBoard(rows ...string) []string {
+	board := []string{}
+	for _, row := range rows {
+		for _, cell := range row {
+			if cell == '.' {
+				board = append(board, "")
+			} else {
+				board = append(board, string(cell))
+			}
+		}
+	}
+	return board
+}
+
+func TestFindWinner(t *testing.T) {
+	tests := []struct {
+		name      string
+		rows      []string
+		winLength int
+		want      string
+	}{
+		{"empty", []string{"...", "...", "..."}, 3, ""},
+		{"row", []string{"...", "OOO", "X.X"}, 3, "O"},
+		{"column", []string{"X.O", "X.O", "X.."}, 3, "X"},
+		{"diagonal", []string{"X.O", ".XO", "..X"}, 3, "X"},
+		{"anti-diagonal", []string{"X.O", ".OX", "O.X"}, 3, "O"},
+		{"full without line", []string{"XOX", "XOO", "OXX"}, 3, ""},
+		{"short line on wide board", []string{"..XXX..", ".......", "......."}, 3, "X"},
+		{"line too short", []string{"XX.XX", ".....", ".....", ".....", "....."}, 3, ""},
+		{"long board needs four", []string{"OOO....", ".......", ".......", "......."}, 4, ""},
+		{"four on long board", []string{".......", ".OOOO..", ".......", "......."}, 4, "O"},
+		{"does not wrap rows", []string{"...XX", "X....", "....."}, 3, ""},
+		{"diagonal off the edge", []string{"....", "...X", "..X.", ".X.."}, 3, "X"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			board := parseBoard(tt.rows...)
+			width := len(tt.rows[0])
+			got := findWinner(board, width, len(tt.rows), tt.winLength)
+			if got != tt.want {
+				t.Fatalf("findWinner(%s) = %q, want %q", strings.Join(tt.rows, "/"), got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNewGameRules(t *testing.T) {
+	tests := []struct {
+		name                     string
+		variant                  string
+		width, height, winLength int
+		want                     gameRules
+		wantErr                  bool
+	}{
+		{name: "defaults", want: gameRules{Variant: variantClassic, Width: 3, Height: 3, WinLength: 3}},
+		{name: "square from width", width: 7, want: gameRules{Variant: variantClassic, Width: 7, Height: 7, WinLength: 5}},
+		{name: "rectangle", width: 6, height: 4, want: gameRules{Variant: variantClassic, Width: 6, Height: 4, WinLength: 4}},
+		{name: "explicit win length", width: 10, winLength: 3, want: gameRules{Variant: variantClassic, Width: 10, Height: 10, WinLength: 3}},
+		{name: "win length up to the longer side", width: 6, height: 3, winLength: 6, want: gameRules{Variant: variantClassic, Width: 6, Height: 3, WinLength: 6}},
+		{name: "too small", width: 2, wantErr: true},
+		{name: "too large", width: 16, wantErr: true},
+		{name: "win length too short", width: 5, winLength: 2, wantErr: true},
+		{name: "win length too long", width: 4, winLength: 5, wantErr: true},
+		{name: "ultimate", variant: variantUltimate, want: gameRules{Variant: variantUltimate, Width: 3, Height: 3, WinLength: 3}},
+		{name: "ultimate size is fixed", variant: variantUltimate, width: 4, wantErr: true},
+		{name: "unknown variant", variant: "gomoku", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := newGameRules(tt.variant, tt.width, tt.height, tt.winLength)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("newGameRules() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("newGameRules() error: %v", err)
+			}
+			if got != tt.want {
+				t.Fatalf("newGameRules() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWinnerFromLine(t *testing.T) {
+	tests := []struct {
+		line   string
+		misere bool
+		want   string
+	}{
+		{"", false, ""},
+		{"", true, ""},
+		{symbolX, false, symbolX},
+		{symbolO, false, symbolO},
+		{symbolX, true, symbolO},
+		{symbolO, true, symbolX},
+	}
+	for _, tt := range tests {
+		rules := defaultRules()
+		rules.Misere = tt.misere
+		if got := rules.winnerFromLine(tt.line); got != tt.want {
+			t.Errorf("winnerFromLine(%q) with misere=%v = %q, want %q", tt.line, tt.misere, got, tt.want)
+		}
+	}
+}
+
+func TestCheckWinnerMisere(t *testing.T) {
+	for _, misere := range []bool{false, true} {
+		rules := defaultRules()
+		rules.Misere = misere
+		room := &Room{rules: rules, board: parseBoard("XXX", "OO.", "...")}
+		want := symbolX
+		if misere {
+			want = symbolO
+		}
+		if got := room.checkWinner(); got != want {
+			t.Errorf("checkWinner() with misere=%v = %q, want %q", misere, got, want)
+		}
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+const (
+	opponentHuman = "human"
+	opponentBot   = "bot"
+)
+
+const (
+	botRandom  = "random"
+	botEasy    = "easy"
+	botMedium  = "medium"
+	botPerfect = "perfect"
+)
+
+const (
+	botMinDelay = 400 * time.Millisecond
+	botMaxDelay = 1200 * time.Millisecond
+)
+
+func normalizeBotDifficulty(raw string) (string, error) {
+	switch raw {
+	case "":
+		return botMedium, nil
+	case botRandom, botEasy, botMedium, botPerfect:
+		return raw, nil
+	default:
+		return "", errors.New("unknown bot difficulty")
+	}
+}
+
+func newBotPlayer(difficulty string) *Player {
+	return &Player{
+		id:        randomID(),
+		name:      "Bot (" + difficulty + ")",
+		symbol:    symbolO,
+		bot:       true,
+		connected: true,
+	}
+}
+
+func botMoveDelay() time.Duration {
+	return botMinDelay + rand.N(botMaxDelay-botMinDelay)
+}
+
+func (r *Room) botPlayerLocked() *Player {
+	if r.playerX != nil && r.playerX.bot {
+		return r.playerX
+	}
+	if r.playerO != nil && r.playerO.bot {
+		return r.playerO
+	}
+	return nil
+}
+
+func (s *Server) scheduleBotMove(room *Room) {
+	room.mu.Lock()
+	defer room.mu.Unlock()
+
+	bot := room.botPlayerLocked()
+	if room.closed || bot == nil || room.botTimer != nil {
+		return
+	}
+	if room.turn != bot.symbol || room.winner != "" || room.draw {
+		return
+	}
+	if !playerConnected(room.playerX) || !playerConnected(room.playerO) {
+		return
+	}
+
+	room.botTimer = time.AfterFunc(botMoveDelay(), func() {
+		s.playBotMove(room)
+	})
+}
+
+func (s *Server) playBotMove(room *Room) {
+	room.mu.Lock()
+	room.botTimer = nil
+	bot := room.botPlayerLocked()
+	if room.closed || bot == nil || room.turn != bot.symbol || room.winner != "" || room.draw {
+		room.mu.Unlock()
+		return
+	}
+	move, ok := chooseBotMove(room, room.botDifficulty)
+	room.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	move.RoomCode = room.code
+	if err := s.applyMove(room, bot, move); err != nil {
+		log.Printf("bot move failed: %v", err)
+	}
+}
+
+func chooseBotMove(r *Room, difficulty string) (movePayload, bool) {
+	moves := r.legalMovesLocked()
+	if len(moves) == 0 {
+		return movePayload{}, false
+	}
+
+	switch difficulty {
+	case botRandom:
+		return pickMove(moves), true
+	case botEasy:
+		if winning := r.movesWinningFor(moves, r.turn, r.turn); len(winning) > 0 {
+			return pickMove(winning), true
+		}
+		return pickMove(moves), true
+	case botPerfect:
+		if canSolve(r.rules) {
+			return r.bestSolvedMoveLocked(), true
+		}
+	}
+	return r.heuristicMoveLocked(moves), true
+}
+
+// heuristicMoveLocked wins when it can, blocks the opponent's immediate win,
+// and otherwise avoids moves that lose on the spot (relevant under misère).
+func (r *Room) heuristicMoveLocked(moves []movePayload) movePayload {
+	me := r.turn
+	opponent := otherSymbol(me)
+	if winning := r.movesWinningFor(moves, me, me); len(winning) > 0 {
+		return pickMove(winning)
+	}
+	if blocking := r.movesWinningFor(moves, opponent, opponent); len(blocking) > 0 {
+		return pickMove(blocking)
+	}
+
+	safe := []movePayload{}
+	losing := r.movesWinningFor(moves, me, opponent)
+	for _, move := range moves {
+		if !containsMove(losing, move) {
+			safe = append(safe, move)
+		}
+	}
+	if len(safe) > 0 {
+		return pickMove(safe)
+	}
+	return pickMove(moves)
+}
+
+func (r *Room) bestSolvedMoveLocked() movePayload {
+	sv := newSolver(r.rules)
+	best := []movePayload{}
+	bestScore := 0
+	for cell, value := range r.board {
+		if value != "" {
+			continue
+		}
+		score := sv.evaluateMove(r.board, r.turn, cell).score()
+		if len(best) == 0 || score > bestScore {
+			best = []movePayload{{Cell: cell}}
+			bestScore = score
+		} else if score == bestScore {
+			best = append(best, movePayload{Cell: cell})
+		}
+	}
+	return pickMove(best)
+}
+
+// movesWinningFor returns the moves that, played by symbol, end the game with
+// winner taking it.
+func (r *Room) movesWinningFor(moves []movePayload, symbol, winner string) []movePayload {
+	result := []movePayload{}
+	for _, move := range moves {
+		clone := r.cloneGameLocked()
+		if err := clone.placeLocked(symbol, move); err != nil {
+			continue
+		}
+		if clone.checkWinner() == winner {
+			result = append(result, move)
+		}
+	}
+	return result
+}
+
+func (r *Room) legalMovesLocked() []movePayload {
+	moves := []movePayload{}
+	if r.rules.Variant == variantUltimate {
+		for sub := 0; sub < ultimateBoards; sub++ {
+			if r.subWinners[sub] != "" || (r.forcedBoard != noForcedBoard && sub != r.forcedBoard) {
+				continue
+			}
+			for cell := 0; cell < ultimateCells; cell++ {
+				if r.board[sub*ultimateCells+cell] == "" {
+					moves = append(moves, movePayload{SubBoard: sub, Cell: cell})
+				}
+			}
+		}
+		return moves
+	}
+	for cell, value := range r.board {
+		if value == "" {
+			moves = append(moves, movePayload{Cell: cell})
+		}
+	}
+	return moves
+}
+
+func (r *Room) cloneGameLocked() *Room {
+	clone := &Room{
+		rules:       r.rules,
+		turn:        r.turn,
+		forcedBoard: r.forcedBoard,
+		board:       append([]string(nil), r.board...),
+	}
+	if r.subWinners != nil {
+		clone.subWinners = append([]string(nil), r.subWinners...)
+	}
+	return clone
+}
+
+func pickMove(moves []movePayload) movePayload {
+	return moves[rand.IntN(len(moves))]
+}
+
+func containsMove(moves []movePayload, target movePayload) bool {
+	for _, move := range moves {
+		if move.SubBoard == target.SubBoard && move.Cell == target.Cell {
+			return true
+		}
+	}
+	return false
+}
@@ -25,6 +25,18 @@ var (
 )
 
 func openDB(path string) (*sql.DB, error) {
+	conn, err := connectDB(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateDB(conn); err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+func connectDB(path string) (*sql.DB, error) {
 	if path == "" {
 		return nil, errors.New("DB_PATH is empty")
 	}
@@ -44,10 +56,6 @@ func openDB(path string) (*sql.DB, error) {
 		_ = conn.Close()
 		return nil, err
 	}
-	if err := migrateDB(conn); err != nil {
-		_ = conn.Close()
-		return nil, err
-	}
 	return conn, nil
 }
 
@@ -65,64 +73,6 @@ func applyPragmas(db *sql.DB) error {
 	return nil
 }
 
-func migrateDB(db *sql.DB) error {
-	migrations := []string{
-		`CREATE TABLE IF NOT EXISTS users (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			discord_id TEXT UNIQUE,
-			guest_id TEXT UNIQUE,
-			username TEXT NOT NULL,
-			avatar TEXT,
-			is_guest INTEGER NOT NULL DEFAULT 1,
-			created_at INTEGER NOT NULL
-		);`,
-		`CREATE TABLE IF NOT EXISTS sessions (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			access_token_hash TEXT NOT NULL,
-			access_expires_at INTEGER NOT NULL,
-			refresh_token_hash TEXT NOT NULL,
-			refresh_expires_at INTEGER NOT NULL,
-			created_at INTEGER NOT NULL,
-			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE TABLE IF NOT EXISTS ws_tickets (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			user_id INTEGER NOT NULL,
-			ticket_hash TEXT NOT NULL,
-			expires_at INTEGER NOT NULL,
-			used INTEGER NOT NULL DEFAULT 0,
-			created_at INTEGER NOT NULL,
-			FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
-		);`,
-		`CREATE TABLE IF NOT EXISTS games (
-			id INTEGER PRIMARY KEY AUTOINCREMENT,
-			room_code TEXT NOT NULL,
-			started_at INTEGER NOT NULL,
-			ended_at INTEGER NOT NULL,
-			winner_symbol TEXT,
-			is_draw INTEGER NOT NULL DEFAULT 0,
-			player_x_user_id INTEGER,
-			player_o_user_id INTEGER,
-			player_x_name TEXT,
-			player_o_name TEXT,
-			FOREIGN KEY(player_x_user_id) REFERENCES users(id),
-			FOREIGN KEY(player_o_user_id) REFERENCES users(id)
-		);`,
-		"CREATE INDEX IF NOT EXISTS idx_sessions_access ON sessions(access_token_hash);",
-		"CREATE INDEX IF NOT EXISTS idx_sessions_refresh ON sessions(refresh_token_hash);",
-		"CREATE INDEX IF NOT EXISTS idx_ws_ticket_hash ON ws_tickets(ticket_hash);",
-		"CREATE INDEX IF NOT EXISTS idx_games_player_x ON games(player_x_user_id);",
-		"CREATE INDEX IF NOT EXISTS idx_games_player_o ON games(player_o_user_id);",
-	}
-	for _, stmt := range migrations {
-		if _, err := db.Exec(stmt); err != nil {
-			return fmt.Errorf("migration failed: %w", err)
-		}
-	}
-	return nil
-}
-
 func hashToken(token string) string {
 	sum := sha256.Sum256([]byte(token))
 	return hex.EncodeToString(sum[:])
@@ -2,11 +2,18 @@ package main
 
 import (
 	"database/sql"
+	"strings"
 	"time"
 )
 
 type gameRecord struct {
 	RoomCode     string
+	Variant      string
+	Width        int
+	Height       int
+	WinLength    int
+	Misere       bool
+	BotLevel     string
 	StartedAt    int64
 	EndedAt      int64
 	WinnerSymbol string
@@ -15,31 +22,114 @@ type gameRecord struct {
 	PlayerOID    int64
 	PlayerXName  string
 	PlayerOName  string
+	Moves        []moveRecord
+
+	TournamentMatchID int64
+	ImportedBy        int64
+}
+
+type moveRecord struct {
+	Ply       int    `json:"ply"`
+	Symbol    string `json:"symbol"`
+	SubBoard  int    `json:"sub_board,omitempty"`
+	Cell      int    `json:"cell"`
+	ElapsedMs int64  `json:"elapsed_ms"`
+}
+
+type gameDetail struct {
+	ID           int64        `json:"id"`
+	RoomCode     string       `json:"room_code"`
+	Variant      string       `json:"variant"`
+	Width        int          `json:"width"`
+	Height       int          `json:"height"`
+	WinLength    int          `json:"win_length"`
+	Misere       bool         `json:"misere"`
+	BotLevel     string       `json:"bot_level,omitempty"`
+	StartedAt    int64        `json:"started_at"`
+	EndedAt      int64        `json:"ended_at"`
+	WinnerSymbol string       `json:"winner_symbol"`
+	IsDraw       bool         `json:"is_draw"`
+	PlayerXID    int64        `json:"player_x_user_id,omitempty"`
+	PlayerOID    int64        `json:"player_o_user_id,omitempty"`
+	PlayerXName  string       `json:"player_x_name"`
+	PlayerOName  string       `json:"player_o_name"`
+	Moves        []moveRecord `json:"moves"`
+
+	importedBy int64
 }
 
 type historyItem struct {
-	ID           int64  `json:"id"`
-	RoomCode     string `json:"room_code"`
-	StartedAt    int64  `json:"started_at"`
-	EndedAt      int64  `json:"ended_at"`
-	Result       string `json:"result"`
-	WinnerSymbol string `json:"winner_symbol"`
-	YourSymbol   string `json:"your_symbol"`
-	OpponentName string `json:"opponent_name"`
+	ID           int64        `json:"id"`
+	RoomCode     string       `json:"room_code"`
+	Variant      string       `json:"variant"`
+	Misere       bool         `json:"misere"`
+	BotLevel     string       `json:"bot_level,omitempty"`
+	StartedAt    int64        `json:"started_at"`
+	EndedAt      int64        `json:"ended_at"`
+	Result       string       `json:"result"`
+	WinnerSymbol string       `json:"winner_symbol"`
+	YourSymbol   string       `json:"your_symbol"`
+	OpponentName string       `json:"opponent_name"`
+	Moves        []moveRecord `json:"moves"`
 }
 
-type statsResponse struct {
+type resultCounts struct {
 	Total  int `json:"total"`
 	Wins   int `json:"wins"`
 	Losses int `json:"losses"`
 	Draws  int `json:"draws"`
 }
 
-func (s *Server) recordGame(record gameRecord) error {
-	_, err := s.db.Exec(
-		`INSERT INTO games (room_code, started_at, ended_at, winner_symbol, is_draw, player_x_user_id, player_o_user_id, player_x_name, player_o_name)
-		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+// recordGame stores a finished live game and, for rated games, the players'
+// new ratings in the same transaction. The returned changes are keyed by
+// symbol and nil when the game was unrated.
+func (s *Server) recordGame(record gameRecord) (map[string]ratingChange, error) {
+	var changes map[string]ratingChange
+	var tournamentID int64
+	err := withTx(s.db, func(tx *sql.Tx) error {
+		gameID, err := storeGame(tx, record)
+		if err != nil {
+			return err
+		}
+		if changes, err = applyRatings(tx, gameID, record); err != nil {
+			return err
+		}
+		if record.TournamentMatchID != 0 {
+			tournamentID, err = ingestTournamentGame(tx, record.TournamentMatchID, gameID, record)
+		}
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if tournamentID != 0 {
+		s.tournamentChanged(tournamentID)
+	}
+	return changes, nil
+}
+
+func storeGame(tx *sql.Tx, record gameRecord) (int64, error) {
+	gameID, err := insertGame(tx, record)
+	if err != nil {
+		return 0, err
+	}
+	if err := insertMoves(tx, gameID, record.Moves); err != nil {
+		return 0, err
+	}
+	return gameID, nil
+}
+
+func insertGame(tx *sql.Tx, record gameRecord) (int64, error) {
+	res, err := tx.Exec(
+		`INSERT INTO games (room_code, variant, width, height, win_length, misere, bot_level, started_at, ended_at, winner_symbol, is_draw, player_x_user_id, player_o_user_id, player_x_name, player_o_name, imported_by)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
 		record.RoomCode,
+		record.Variant,
+		record.Width,
+		record.Height,
+		record.WinLength,
+		boolToInt(record.Misere),
+		nullIfEmpty(record.BotLevel),
 		record.StartedAt,
 		record.EndedAt,
 		record.WinnerSymbol,
@@ -48,8 +138,59 @@ func (s *Server) recordGame(record gameRecord) error {
 		nullIfZero(record.PlayerOID),
 		record.PlayerXName,
 		record.PlayerOName,
+		nullIfZero(record.ImportedBy),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func insertMoves(tx *sql.Tx, gameID int64, moves []moveRecord) error {
+	for _, move := range moves {
+		if _, err := tx.Exec(
+			"INSERT INTO game_moves (game_id, ply, symbol, sub_board, cell, elapsed_ms) VALUES (?, ?, ?, ?, ?, ?)",
+			gameID, move.Ply, move.Symbol, move.SubBoard, move.Cell, move.ElapsedMs,
+		); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *Server) loadMoves(gameIDs []int64) (map[int64][]moveRecord, error) {
+	result := make(map[int64][]moveRecord)
+	if len(gameIDs) == 0 {
+		return result, nil
+	}
+
+	placeholders := make([]string, len(gameIDs))
+	args := make([]any, len(gameIDs))
+	for i, id := range gameIDs {
+		placeholders[i] = "?"
+		args[i] = id
+	}
+	rows, err := s.db.Query(
+		`SELECT game_id, ply, symbol, sub_board, cell, elapsed_ms
+		 FROM game_moves
+		 WHERE game_id IN (`+strings.Join(placeholders, ", ")+`)
+		 ORDER BY game_id, ply`,
+		args...,
 	)
-	return err
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var gameID int64
+		var move moveRecord
+		if err := rows.Scan(&gameID, &move.Ply, &move.Symbol, &move.SubBoard, &move.Cell, &move.ElapsedMs); err != nil {
+			return nil, err
+		}
+		result[gameID] = append(result[gameID], move)
+	}
+	return result, rows.Err()
 }
 
 func nullIfZero(id int64) any {
@@ -59,31 +200,116 @@ func nullIfZero(id int64) any {
 	return id
 }
 
-func (s *Server) loadHistory(userID int64, limit int) ([]historyItem, error) {
-	rows, err := s.db.Query(
-		`SELECT id, room_code, started_at, ended_at, winner_symbol, is_draw, player_x_user_id, player_o_user_id, player_x_name, player_o_name
+func nullIfEmpty(value string) any {
+	if value == "" {
+		return nil
+	}
+	return value
+}
+
+func (s *Server) loadGame(id int64) (gameDetail, error) {
+	row := s.db.QueryRow(
+		`SELECT id, room_code, variant, width, height, win_length, misere, bot_level, started_at, ended_at, winner_symbol, is_draw, player_x_user_id, player_o_user_id, player_x_name, player_o_name, imported_by
 		 FROM games
+		 WHERE id = ?`,
+		id,
+	)
+	var game gameDetail
+	var misere, isDraw int
+	var botLevel, winnerSymbol, playerXName, playerOName sql.NullString
+	var playerXID, playerOID, importedBy sql.NullInt64
+	if err := row.Scan(&game.ID, &game.RoomCode, &game.Variant, &game.Width, &game.Height, &game.WinLength, &misere, &botLevel, &game.StartedAt, &game.EndedAt, &winnerSymbol, &isDraw, &playerXID, &playerOID, &playerXName, &playerOName, &importedBy); err != nil {
+		return gameDetail{}, err
+	}
+	game.Misere = misere == 1
+	game.IsDraw = isDraw == 1
+	game.BotLevel = botLevel.String
+	game.WinnerSymbol = winnerSymbol.String
+	game.PlayerXID = nullInt(playerXID)
+	game.PlayerOID = nullInt(playerOID)
+	game.PlayerXName = playerXName.String
+	game.PlayerOName = playerOName.String
+	game.importedBy = nullInt(importedBy)
+
+	moves, err := s.loadMoves([]int64{game.ID})
+	if err != nil {
+		return gameDetail{}, err
+	}
+	game.Moves = moves[game.ID]
+	if game.Moves == nil {
+		game.Moves = []moveRecord{}
+	}
+	return game, nil
+}
+
+// viewableBy reports whether userID held either seat in the game or imported
+// it; nobody else gets to read it.
+func (g gameDetail) viewableBy(userID int64) bool {
+	return userID != 0 && (g.PlayerXID == userID || g.PlayerOID == userID || g.importedBy == userID)
+}
+
+func (s *Server) loadGameIDs(userID int64) ([]int64, error) {
+	rows, err := s.db.Query(
+		`SELECT id FROM games
 		 WHERE player_x_user_id = ? OR player_o_user_id = ?
-		 ORDER BY ended_at DESC
-		 LIMIT ?`,
-		userID, userID, limit,
+		 ORDER BY ended_at ASC, id ASC`,
+		userID, userID,
 	)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
+	ids := []int64{}
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *Server) loadHistory(userID int64, filter historyFilter) (historyPage, error) {
+	where, args := historyWhere(userID, filter)
+
+	page := historyPage{Items: []historyItem{}}
+	if err := s.db.QueryRow("SELECT COUNT(*) FROM games WHERE "+where, args...).Scan(&page.Total); err != nil {
+		return historyPage{}, err
+	}
+
+	if filter.Cursor != nil {
+		where += " AND (ended_at < ? OR (ended_at = ? AND id < ?))"
+		args = append(args, filter.Cursor.EndedAt, filter.Cursor.EndedAt, filter.Cursor.ID)
+	}
+	args = append(args, filter.Limit+1)
+	rows, err := s.db.Query(
+		`SELECT id, room_code, variant, misere, bot_level, started_at, ended_at, winner_symbol, is_draw, player_x_user_id, player_o_user_id, player_x_name, player_o_name
+		 FROM games
+		 WHERE `+where+`
+		 ORDER BY ended_at DESC, id DESC
+		 LIMIT ?`,
+		args...,
+	)
+	if err != nil {
+		return historyPage{}, err
+	}
+	defer rows.Close()
+
 	items := []historyItem{}
 	for rows.Next() {
 		var item historyItem
-		var winnerSymbol sql.NullString
-		var isDraw int
+		var winnerSymbol, botLevel sql.NullString
+		var isDraw, misere int
 		var playerXID, playerOID sql.NullInt64
 		var playerXName, playerOName sql.NullString
-		if err := rows.Scan(&item.ID, &item.RoomCode, &item.StartedAt, &item.EndedAt, &winnerSymbol, &isDraw, &playerXID, &playerOID, &playerXName, &playerOName); err != nil {
-			return nil, err
+		if err := rows.Scan(&item.ID, &item.RoomCode, &item.Variant, &misere, &botLevel, &item.StartedAt, &item.EndedAt, &winnerSymbol, &isDraw, &playerXID, &playerOID, &playerXName, &playerOName); err != nil {
+			return historyPage{}, err
 		}
 		item.WinnerSymbol = winnerSymbol.String
+		item.Misere = misere == 1
+		item.BotLevel = botLevel.String
 		if playerXID.Valid && playerXID.Int64 == userID {
 			item.YourSymbol = symbolX
 			item.OpponentName = playerOName.String
@@ -100,39 +326,32 @@ func (s *Server) loadHistory(userID int64, limit int) ([]historyItem, error) {
 		}
 		items = append(items, item)
 	}
-	return items, rows.Err()
-}
+	if err := rows.Err(); err != nil {
+		return historyPage{}, err
+	}
 
-func (s *Server) loadStats(userID int64) (statsResponse, error) {
-	var stats statsResponse
-	row := s.db.QueryRow(
-		`SELECT
-		 COUNT(*) as total,
-		 SUM(CASE WHEN is_draw = 1 THEN 1 ELSE 0 END) as draws,
-		 SUM(CASE
-			 WHEN winner_symbol = ? AND player_x_user_id = ? THEN 1
-			 WHEN winner_symbol = ? AND player_o_user_id = ? THEN 1
-			 ELSE 0
-		 END) as wins,
-		 SUM(CASE
-			 WHEN winner_symbol = ? AND player_o_user_id = ? THEN 1
-			 WHEN winner_symbol = ? AND player_x_user_id = ? THEN 1
-			 ELSE 0
-		 END) as losses
-		 FROM games
-		 WHERE player_x_user_id = ? OR player_o_user_id = ?`,
-		symbolX, userID, symbolO, userID, symbolX, userID, symbolO, userID, userID, userID,
-	)
-	var draws sql.NullInt64
-	var wins sql.NullInt64
-	var losses sql.NullInt64
-	if err := row.Scan(&stats.Total, &draws, &wins, &losses); err != nil {
-		return statsResponse{}, err
+	if len(items) > filter.Limit {
+		items = items[:filter.Limit]
+		last := items[len(items)-1]
+		page.NextCursor = encodeHistoryCursor(historyCursor{EndedAt: last.EndedAt, ID: last.ID})
+	}
+
+	ids := make([]int64, len(items))
+	for i, item := range items {
+		ids[i] = item.ID
 	}
-	stats.Draws = int(nullInt(draws))
-	stats.Wins = int(nullInt(wins))
-	stats.Losses = int(nullInt(losses))
-	return stats, nil
+	moves, err := s.loadMoves(ids)
+	if err != nil {
+		return historyPage{}, err
+	}
+	for i := range items {
+		items[i].Moves = moves[items[i].ID]
+		if items[i].Moves == nil {
+			items[i].Moves = []moveRecord{}
+		}
+	}
+	page.Items = items
+	return page, nil
 }
 
 func nullInt(value sql.NullInt64) int64 {
@@ -145,9 +364,17 @@ func nullInt(value sql.NullInt64) int64 {
 func buildGameRecord(room *Room, endedAt time.Time) gameRecord {
 	record := gameRecord{
 		RoomCode:  room.code,
+		Variant:   room.rules.Variant,
+		Width:     room.rules.Width,
+		Height:    room.rules.Height,
+		WinLength: room.rules.WinLength,
+		Misere:    room.rules.Misere,
+		BotLevel:  room.botDifficulty,
 		StartedAt: room.startedAt.Unix(),
 		EndedAt:   endedAt.Unix(),
 		IsDraw:    room.draw,
+
+		TournamentMatchID: room.tournamentMatchID,
 	}
 	if room.winner != "" {
 		record.WinnerSymbol = room.winner
@@ -160,5 +387,7 @@ func buildGameRecord(room *Room, endedAt time.Time) gameRecord {
 		record.PlayerOID = room.playerO.userID
 		record.PlayerOName = room.playerO.name
 	}
+	record.Moves = make([]moveRecord, len(room.moves))
+	copy(record.Moves, room.moves)
 	return record
 }
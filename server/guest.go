@@ -0,0 +1,104 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+)
+
+const guestTokenPurpose = "guest"
+
+var errGuestClaimed = errors.New("guest id already claimed")
+
+type guestClaims struct {
+	GuestID string `json:"g"`
+}
+
+type guestRequest struct {
+	LegacyGuestID string `json:"legacy_guest_id,omitempty"`
+}
+
+type guestResponse struct {
+	GuestToken string `json:"guest_token"`
+}
+
+// handleGuest issues a signed guest token. Clients that still hold a raw
+// guest id from before tokens existed send it as legacy_guest_id once to keep
+// that guest's history; each legacy id can only be claimed once.
+func (s *Server) handleGuest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	var payload guestRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&payload); err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, "invalid guest payload", http.StatusBadRequest)
+		return
+	}
+
+	guestID, err := s.issueGuestID(payload.LegacyGuestID)
+	if errors.Is(err, errGuestClaimed) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("guest issue failed: %v", err)
+		http.Error(w, "guest failed", http.StatusInternalServerError)
+		return
+	}
+	token, err := signToken(s.signingKey, guestTokenPurpose, guestClaims{GuestID: guestID})
+	if err != nil {
+		log.Printf("guest issue failed: %v", err)
+		http.Error(w, "guest failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, guestResponse{GuestToken: token}, http.StatusOK)
+}
+
+// issueGuestID claims an unclaimed legacy guest row, or mints a new id when
+// the legacy id is unknown or absent.
+func (s *Server) issueGuestID(legacy string) (string, error) {
+	legacy = normalizeGuestID(legacy)
+	if legacy == "" {
+		return "g_" + randomToken(18), nil
+	}
+
+	res, err := s.db.Exec(
+		"UPDATE users SET guest_claimed_at = ? WHERE guest_id = ? AND is_guest = 1 AND guest_claimed_at IS NULL",
+		nowUnix(), legacy,
+	)
+	if err != nil {
+		return "", err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return "", err
+	} else if affected == 1 {
+		return legacy, nil
+	}
+
+	var userID int64
+	err = s.db.QueryRow("SELECT id FROM users WHERE guest_id = ?", legacy).Scan(&userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "g_" + randomToken(18), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return "", errGuestClaimed
+}
+
+// guestIDFromToken returns the guest id inside a valid guest token, or "" for
+// anything else, including raw guest ids.
+func (s *Server) guestIDFromToken(token string) string {
+	if token == "" {
+		return ""
+	}
+	var claims guestClaims
+	if err := verifyToken(s.signingKey, guestTokenPurpose, token, &claims); err != nil {
+		return ""
+	}
+	return normalizeGuestID(claims.GuestID)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultHeadToHeadGames = 10
+	maxHeadToHeadGames     = 50
+)
+
+type headToHeadSummary struct {
+	OpponentID   int64  `json:"opponent_id"`
+	OpponentName string `json:"opponent_name"`
+	resultCounts
+}
+
+type headToHeadResponse struct {
+	headToHeadSummary
+	LastGames []historyItem `json:"last_games"`
+}
+
+func (s *Server) handleHeadToHead(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.userFromRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	opponentID, err := strconv.ParseInt(r.URL.Query().Get("opponent"), 10, 64)
+	if err != nil || opponentID <= 0 || opponentID == user.ID {
+		http.Error(w, "invalid opponent", http.StatusBadRequest)
+		return
+	}
+	limit := defaultHeadToHeadGames
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(limit, maxHeadToHeadGames)
+	}
+
+	summary, err := s.loadHeadToHead(user.ID, opponentID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "opponent not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("head-to-head load failed: %v", err)
+		http.Error(w, "head-to-head failed", http.StatusInternalServerError)
+		return
+	}
+
+	response := headToHeadResponse{headToHeadSummary: summary, LastGames: []historyItem{}}
+	if limit > 0 {
+		page, err := s.loadHistory(user.ID, historyFilter{Limit: limit, OpponentID: opponentID})
+		if err != nil {
+			log.Printf("head-to-head load failed: %v", err)
+			http.Error(w, "head-to-head failed", http.StatusInternalServerError)
+			return
+		}
+		response.LastGames = page.Items
+	}
+
+	writeJSON(w, response, http.StatusOK)
+}
+
+// loadHeadToHead returns userID's record against opponentID. It fails with
+// sql.ErrNoRows when the opponent does not exist.
+func (s *Server) loadHeadToHead(userID, opponentID int64) (headToHeadSummary, error) {
+	summary := headToHeadSummary{OpponentID: opponentID}
+	if err := s.db.QueryRow("SELECT username FROM users WHERE id = ?", opponentID).Scan(&summary.OpponentName); err != nil {
+		return headToHeadSummary{}, err
+	}
+
+	where, args := historyWhere(userID, historyFilter{OpponentID: opponentID})
+	args = append([]any{symbolX, userID, symbolO, userID, symbolX, userID, symbolO, userID}, args...)
+	var draws, wins, losses sql.NullInt64
+	err := s.db.QueryRow(
+		`SELECT
+		 COUNT(*),
+		 SUM(CASE WHEN is_draw = 1 THEN 1 ELSE 0 END),
+		 SUM(CASE
+			 WHEN is_draw = 1 THEN 0
+			 WHEN winner_symbol = ? AND player_x_user_id = ? THEN 1
+			 WHEN winner_symbol = ? AND player_o_user_id = ? THEN 1
+			 ELSE 0
+		 END),
+		 SUM(CASE
+			 WHEN is_draw = 1 THEN 0
+			 WHEN winner_symbol = ? AND player_o_user_id = ? THEN 1
+			 WHEN winner_symbol = ? AND player_x_user_id = ? THEN 1
+			 ELSE 0
+		 END)
+		 FROM games
+		 WHERE `+where,
+		args...,
+	).Scan(&summary.Total, &draws, &wins, &losses)
+	if err != nil {
+		return headToHeadSummary{}, err
+	}
+	summary.Draws = int(nullInt(draws))
+	summary.Wins = int(nullInt(wins))
+	summary.Losses = int(nullInt(losses))
+	return summary, nil
+}
+
+// seatedHeadToHead returns player's record against the other seated player
+// when both have user ids, or nil otherwise.
+func (s *Server) seatedHeadToHead(room *Room, player *Player) *headToHeadSummary {
+	room.mu.Lock()
+	opponent := room.playerO
+	if player == room.playerO {
+		opponent = room.playerX
+	}
+	var userID, opponentID int64
+	if (player == room.playerX || player == room.playerO) && opponent != nil && !opponent.bot {
+		userID, opponentID = player.userID, opponent.userID
+	}
+	room.mu.Unlock()
+
+	if userID == 0 || opponentID == 0 || userID == opponentID {
+		return nil
+	}
+	summary, err := s.loadHeadToHead(userID, opponentID)
+	if err != nil {
+		log.Printf("head-to-head load failed: %v", err)
+		return nil
+	}
+	return &summary
+}
+
+// sendHeadToHead pushes player's record against the other seat as a
+// head_to_head message, for seats that did not get it in their join response.
+func (s *Server) sendHeadToHead(room *Room, player *Player) {
+	if summary := s.seatedHeadToHead(room, player); summary != nil {
+		_ = player.send(newMessage("head_to_head", summary))
+	}
+}
+
+// sendOpponentHeadToHead gives the seat already in the room its record
+// against a player who just sat down.
+func (s *Server) sendOpponentHeadToHead(room *Room, player *Player) {
+	room.mu.Lock()
+	var opponent *Player
+	switch player {
+	case room.playerX:
+		opponent = room.playerO
+	case room.playerO:
+		opponent = room.playerX
+	}
+	room.mu.Unlock()
+	if opponent != nil {
+		s.sendHeadToHead(room, opponent)
+	}
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultHistoryLimit = 50
+	maxHistoryLimit     = 200
+)
+
+type historyCursor struct {
+	EndedAt int64
+	ID      int64
+}
+
+type historyFilter struct {
+	Limit      int
+	Cursor     *historyCursor
+	Result     string
+	OpponentID int64
+	Opponent   string
+	Symbol     string
+	From       int64
+	To         int64
+}
+
+type historyPage struct {
+	Items      []historyItem `json:"items"`
+	Total      int           `json:"total"`
+	NextCursor string        `json:"next_cursor,omitempty"`
+}
+
+func parseHistoryFilter(query url.Values) (historyFilter, error) {
+	filter := historyFilter{Limit: defaultHistoryLimit}
+
+	if raw := query.Get("limit"); raw != "" {
+		limit, err := strconv.Atoi(raw)
+		if err != nil || limit <= 0 {
+			return historyFilter{}, errors.New("invalid limit")
+		}
+		filter.Limit = min(limit, maxHistoryLimit)
+	}
+	if raw := query.Get("cursor"); raw != "" {
+		cursor, err := decodeHistoryCursor(raw)
+		if err != nil {
+			return historyFilter{}, err
+		}
+		filter.Cursor = &cursor
+	}
+
+	switch result := query.Get("result"); result {
+	case "", "win", "loss", "draw":
+		filter.Result = result
+	default:
+		return historyFilter{}, errors.New("invalid result filter")
+	}
+
+	switch symbol := strings.ToUpper(query.Get("symbol")); symbol {
+	case "", symbolX, symbolO:
+		filter.Symbol = symbol
+	default:
+		return historyFilter{}, errors.New("invalid symbol filter")
+	}
+
+	if raw := query.Get("opponent_id"); raw != "" {
+		id, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil || id <= 0 {
+			return historyFilter{}, errors.New("invalid opponent_id")
+		}
+		filter.OpponentID = id
+	}
+	filter.Opponent = strings.TrimSpace(query.Get("opponent"))
+
+	var err error
+	if filter.From, err = parseTimeParam(query.Get("from"), false); err != nil {
+		return historyFilter{}, fmt.Errorf("invalid from: %w", err)
+	}
+	if filter.To, err = parseTimeParam(query.Get("to"), true); err != nil {
+		return historyFilter{}, fmt.Errorf("invalid to: %w", err)
+	}
+	return filter, nil
+}
+
+// parseTimeParam accepts unix seconds, RFC 3339 or a plain date. A plain date
+// used as an upper bound covers the whole day.
+func parseTimeParam(raw string, endOfDay bool) (int64, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return 0, nil
+	}
+	if seconds, err := strconv.ParseInt(raw, 10, 64); err == nil {
+		return seconds, nil
+	}
+	if t, err := time.Parse(time.RFC3339, raw); err == nil {
+		return t.Unix(), nil
+	}
+	day, err := time.Parse(time.DateOnly, raw)
+	if err != nil {
+		return 0, errors.New("expected unix seconds, RFC 3339 or YYYY-MM-DD")
+	}
+	if endOfDay {
+		return day.Add(24*time.Hour).Unix() - 1, nil
+	}
+	return day.Unix(), nil
+}
+
+func encodeHistoryCursor(cursor historyCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", cursor.EndedAt, cursor.ID)))
+}
+
+func decodeHistoryCursor(raw string) (historyCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(raw)
+	if err != nil {
+		return historyCursor{}, errors.New("invalid cursor")
+	}
+	var cursor historyCursor
+	if _, err := fmt.Sscanf(string(data), "%d:%d", &cursor.EndedAt, &cursor.ID); err != nil {
+		return historyCursor{}, errors.New("invalid cursor")
+	}
+	return cursor, nil
+}
+
+// historyWhere builds the WHERE clause for userID's games. The cursor is left
+// out so the same clause also counts the full filtered set.
+func historyWhere(userID int64, filter historyFilter) (string, []any) {
+	clauses := []string{"(player_x_user_id = ? OR player_o_user_id = ?)"}
+	args := []any{userID, userID}
+
+	switch filter.Symbol {
+	case symbolX:
+		clauses = append(clauses, "player_x_user_id = ?")
+		args = append(args, userID)
+	case symbolO:
+		clauses = append(clauses, "player_o_user_id = ?")
+		args = append(args, userID)
+	}
+
+	won := "((winner_symbol = ? AND player_x_user_id = ?) OR (winner_symbol = ? AND player_o_user_id = ?))"
+	switch filter.Result {
+	case "draw":
+		clauses = append(clauses, "is_draw = 1")
+	case "win":
+		clauses = append(clauses, "is_draw = 0 AND "+won)
+		args = append(args, symbolX, userID, symbolO, userID)
+	case "loss":
+		clauses = append(clauses, "is_draw = 0 AND NOT "+won)
+		args = append(args, symbolX, userID, symbolO, userID)
+	}
+
+	if filter.OpponentID != 0 {
+		clauses = append(clauses, "((player_x_user_id = ? AND player_o_user_id = ?) OR (player_o_user_id = ? AND player_x_user_id = ?))")
+		args = append(args, userID, filter.OpponentID, userID, filter.OpponentID)
+	}
+	if filter.Opponent != "" {
+		pattern := "%" + escapeLike(filter.Opponent) + "%"
+		clauses = append(clauses, `((player_x_user_id = ? AND player_o_name LIKE ? ESCAPE '\') OR (player_o_user_id = ? AND player_x_name LIKE ? ESCAPE '\'))`)
+		args = append(args, userID, pattern, userID, pattern)
+	}
+	if filter.From != 0 {
+		clauses = append(clauses, "ended_at >= ?")
+		args = append(args, filter.From)
+	}
+	if filter.To != 0 {
+		clauses = append(clauses, "ended_at <= ?")
+		args = append(args, filter.To)
+	}
+
+	return strings.Join(clauses, " AND "), args
+}
+
+func escapeLike(value string) string {
+	replacer := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`)
+	return replacer.Replace(value)
+}
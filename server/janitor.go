@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const janitorBatchPause = 50 * time.Millisecond
+
+type janitorConfig struct {
+	Interval         time.Duration
+	BatchSize        int
+	SessionRetention time.Duration
+	TicketRetention  time.Duration
+	GuestRetention   time.Duration
+	RotatedRetention time.Duration
+}
+
+type janitorTask struct {
+	table     string
+	retention time.Duration
+	query     string
+}
+
+type janitor struct {
+	db      *sql.DB
+	config  janitorConfig
+	mu      sync.Mutex
+	deleted map[string]int64
+	runs    atomic.Int64
+	lastRun atomic.Int64
+}
+
+func loadJanitorConfig() janitorConfig {
+	return janitorConfig{
+		Interval:         envDuration("JANITOR_INTERVAL", time.Hour),
+		BatchSize:        envInt("JANITOR_BATCH_SIZE", 500),
+		SessionRetention: envDuration("RETENTION_SESSIONS", 7*24*time.Hour),
+		TicketRetention:  envDuration("RETENTION_WS_TICKETS", time.Hour),
+		GuestRetention:   envDuration("RETENTION_GUESTS", 30*24*time.Hour),
+		RotatedRetention: envDuration("RETENTION_ROTATED_REFRESH", refreshTokenTTL),
+	}
+}
+
+func newJanitor(db *sql.DB, config janitorConfig) *janitor {
+	return &janitor{db: db, config: config, deleted: make(map[string]int64)}
+}
+
+// tasks lists what gets swept. Every query deletes at most one batch of rows
+// older than the cutoff; guests only go once nothing references them, live
+// rooms included.
+func (j *janitor) tasks() []janitorTask {
+	return []janitorTask{
+		{
+			table:     "sessions",
+			retention: j.config.SessionRetention,
+			query: `DELETE FROM sessions WHERE id IN (
+				SELECT id FROM sessions WHERE refresh_expires_at < ? LIMIT ?
+			)`,
+		},
+		{
+			// Rotated tokens are kept as long as they could still be
+			// presented, and go with their session.
+			table:     "rotated_refresh_tokens",
+			retention: j.config.RotatedRetention,
+			query: `DELETE FROM rotated_refresh_tokens WHERE token_hash IN (
+				SELECT r.token_hash FROM rotated_refresh_tokens r
+				WHERE r.rotated_at < ?
+				OR NOT EXISTS (SELECT 1 FROM sessions s WHERE s.id = r.session_id)
+				LIMIT ?
+			)`,
+		},
+		{
+			// Extra access tokens from grace-window refreshes.
+			table:     "session_access_tokens",
+			retention: j.config.SessionRetention,
+			query: `DELETE FROM session_access_tokens WHERE token_hash IN (
+				SELECT a.token_hash FROM session_access_tokens a
+				WHERE a.expires_at < ?
+				OR NOT EXISTS (SELECT 1 FROM sessions s WHERE s.id = a.session_id)
+				LIMIT ?
+			)`,
+		},
+		{
+			table:     "ws_tickets",
+			retention: j.config.TicketRetention,
+			query: `DELETE FROM ws_tickets WHERE id IN (
+				SELECT id FROM ws_tickets WHERE expires_at < ? LIMIT ?
+			)`,
+		},
+		{
+			table:     "guest_users",
+			retention: j.config.GuestRetention,
+			query: `DELETE FROM users WHERE id IN (
+				SELECT u.id FROM users u
+				WHERE u.is_guest = 1 AND COALESCE(u.last_seen_at, u.created_at) < ?
+				AND NOT EXISTS (SELECT 1 FROM games g WHERE g.player_x_user_id = u.id OR g.player_o_user_id = u.id)
+				AND NOT EXISTS (SELECT 1 FROM sessions s WHERE s.user_id = u.id)
+				AND NOT EXISTS (
+					SELECT 1 FROM live_rooms r
+					WHERE json_extract(r.state, '$.player_x.user_id') = u.id
+					OR json_extract(r.state, '$.player_o.user_id') = u.id
+				)
+				LIMIT ?
+			)`,
+		},
+	}
+}
+
+func (j *janitor) run() {
+	if j.config.Interval <= 0 {
+		log.Printf("janitor disabled")
+		return
+	}
+	ticker := time.NewTicker(j.config.Interval)
+	defer ticker.Stop()
+	for {
+		j.sweep()
+		<-ticker.C
+	}
+}
+
+func (j *janitor) sweep() map[string]int64 {
+	report := make(map[string]int64)
+	for _, task := range j.tasks() {
+		if task.retention <= 0 {
+			continue
+		}
+		cutoff := nowUnix() - int64(task.retention.Seconds())
+		removed, err := j.deleteInBatches(task.query, cutoff)
+		if err != nil {
+			log.Printf("janitor %s cleanup failed: %v", task.table, err)
+		}
+		report[task.table] = removed
+	}
+
+	j.mu.Lock()
+	for table, removed := range report {
+		j.deleted[table] += removed
+	}
+	j.mu.Unlock()
+	j.runs.Add(1)
+	j.lastRun.Store(nowUnix())
+
+	log.Printf("janitor removed %s", formatJanitorReport(j.tasks(), report))
+	return report
+}
+
+// deleteInBatches repeats a single-batch delete until it comes back short,
+// pausing between batches so other writers get the lock.
+func (j *janitor) deleteInBatches(query string, cutoff int64) (int64, error) {
+	var total int64
+	for {
+		res, err := j.db.Exec(query, cutoff, j.config.BatchSize)
+		if err != nil {
+			return total, err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return total, err
+		}
+		total += affected
+		if affected < int64(j.config.BatchSize) {
+			return total, nil
+		}
+		time.Sleep(janitorBatchPause)
+	}
+}
+
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	s.mu.RLock()
+	rooms := len(s.rooms)
+	s.mu.RUnlock()
+	fmt.Fprintf(w, "tictactoe_live_rooms %d\n", rooms)
+	fmt.Fprintf(w, "tictactoe_refresh_token_reuse_total %d\n", s.refreshReuse.Load())
+
+	if s.janitor == nil {
+		return
+	}
+	s.janitor.mu.Lock()
+	defer s.janitor.mu.Unlock()
+	for _, task := range s.janitor.tasks() {
+		fmt.Fprintf(w, "tictactoe_janitor_deleted_total{table=%q} %d\n", task.table, s.janitor.deleted[task.table])
+	}
+	fmt.Fprintf(w, "tictactoe_janitor_runs_total %d\n", s.janitor.runs.Load())
+	fmt.Fprintf(w, "tictactoe_janitor_last_run_timestamp_seconds %d\n", s.janitor.lastRun.Load())
+}
+
+func formatJanitorReport(tasks []janitorTask, report map[string]int64) string {
+	parts := []string{}
+	for _, task := range tasks {
+		if removed, ok := report[task.table]; ok {
+			parts = append(parts, fmt.Sprintf("%s=%d", task.table, removed))
+		}
+	}
+	if len(parts) == 0 {
+		return "nothing (all retention disabled)"
+	}
+	return strings.Join(parts, " ")
+}
+
+func envDuration(key string, fallback time.Duration) time.Duration {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	value, err := time.ParseDuration(raw)
+	if err != nil {
+		log.Printf("invalid %s %q, using %s", key, raw, fallback)
+		return fallback
+	}
+	return value
+}
+
+func envInt(key string, fallback int) int {
+	raw := strings.TrimSpace(os.Getenv(key))
+	if raw == "" {
+		return fallback
+	}
+	value, err := strconv.Atoi(raw)
+	if err != nil || value <= 0 {
+		log.Printf("invalid %s %q, using %d", key, raw, fallback)
+		return fallback
+	}
+	return value
+}
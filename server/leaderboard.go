@@ -0,0 +1,401 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultLeaderboardLimit = 50
+	maxLeaderboardLimit     = 100
+	seasonCheckInterval     = 10 * time.Minute
+)
+
+var errSeasonNotFound = errors.New("season not found")
+
+type season struct {
+	ID          int64  `json:"id"`
+	Name        string `json:"name"`
+	StartsAt    int64  `json:"starts_at"`
+	EndsAt      int64  `json:"ends_at"`
+	FinalizedAt int64  `json:"finalized_at,omitempty"`
+}
+
+type leaderboardEntry struct {
+	Rank     int    `json:"rank"`
+	UserID   int64  `json:"user_id"`
+	Username string `json:"username"`
+	Rating   *int   `json:"rating,omitempty"`
+	resultCounts
+}
+
+type leaderboardResponse struct {
+	Season   *season            `json:"season,omitempty"`
+	MinGames int                `json:"min_games"`
+	Entries  []leaderboardEntry `json:"entries"`
+}
+
+type seasonsResponse struct {
+	Seasons []season `json:"seasons"`
+}
+
+// handleLeaderboard ranks registered players over all time, or over one
+// season with ?season=current or ?season={id}. Finalized seasons are served
+// from their snapshot.
+func (s *Server) handleLeaderboard(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	limit := defaultLeaderboardLimit
+	if raw := r.URL.Query().Get("limit"); raw != "" {
+		parsed, err := strconv.Atoi(raw)
+		if err != nil || parsed <= 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+		limit = min(parsed, maxLeaderboardLimit)
+	}
+
+	response := leaderboardResponse{MinGames: s.leaderboardMinGames}
+	var err error
+	switch raw := r.URL.Query().Get("season"); raw {
+	case "", "all":
+		response.Entries, err = s.loadLeaderboard(0, nowUnix()+1, false, s.leaderboardMinGames)
+	default:
+		var current season
+		if raw == "current" {
+			current, err = s.currentSeason(nowUnix())
+		} else {
+			id, parseErr := strconv.ParseInt(raw, 10, 64)
+			if parseErr != nil {
+				http.Error(w, "invalid season", http.StatusBadRequest)
+				return
+			}
+			current, err = s.loadSeason(id)
+		}
+		if err == nil {
+			response.Season = &current
+			if current.FinalizedAt != 0 {
+				response.Entries, err = s.loadSeasonStandings(current.ID)
+			} else {
+				response.Entries, err = s.loadLeaderboard(current.StartsAt, current.EndsAt, true, s.leaderboardMinGames)
+			}
+		}
+	}
+	if errors.Is(err, errSeasonNotFound) {
+		http.Error(w, "season not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("leaderboard load failed: %v", err)
+		http.Error(w, "leaderboard failed", http.StatusInternalServerError)
+		return
+	}
+	if len(response.Entries) > limit {
+		response.Entries = response.Entries[:limit]
+	}
+	writeJSON(w, response, http.StatusOK)
+}
+
+func (s *Server) handleSeasons(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rows, err := s.db.Query("SELECT id, name, starts_at, ends_at, finalized_at FROM seasons ORDER BY starts_at DESC, id DESC")
+	if err != nil {
+		log.Printf("seasons load failed: %v", err)
+		http.Error(w, "seasons failed", http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	response := seasonsResponse{Seasons: []season{}}
+	for rows.Next() {
+		current, err := scanSeason(rows)
+		if err != nil {
+			log.Printf("seasons load failed: %v", err)
+			http.Error(w, "seasons failed", http.StatusInternalServerError)
+			return
+		}
+		response.Seasons = append(response.Seasons, current)
+	}
+	if err := rows.Err(); err != nil {
+		log.Printf("seasons load failed: %v", err)
+		http.Error(w, "seasons failed", http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, response, http.StatusOK)
+}
+
+func scanSeason(row rowScanner) (season, error) {
+	var current season
+	var finalizedAt sql.NullInt64
+	if err := row.Scan(&current.ID, &current.Name, &current.StartsAt, &current.EndsAt, &finalizedAt); err != nil {
+		return season{}, err
+	}
+	current.FinalizedAt = nullInt(finalizedAt)
+	return current, nil
+}
+
+func (s *Server) loadSeason(id int64) (season, error) {
+	current, err := scanSeason(s.db.QueryRow("SELECT id, name, starts_at, ends_at, finalized_at FROM seasons WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return season{}, errSeasonNotFound
+	}
+	return current, err
+}
+
+// currentSeason returns the season covering at; if several overlap, the one
+// that started last wins.
+func (s *Server) currentSeason(at int64) (season, error) {
+	current, err := scanSeason(s.db.QueryRow(
+		`SELECT id, name, starts_at, ends_at, finalized_at FROM seasons
+		 WHERE starts_at <= ? AND ends_at > ?
+		 ORDER BY starts_at DESC, id DESC LIMIT 1`,
+		at, at,
+	))
+	if errors.Is(err, sql.ErrNoRows) {
+		return season{}, errSeasonNotFound
+	}
+	return current, err
+}
+
+// loadLeaderboard aggregates human games ended in [from, to) per registered
+// player. Players with a rating rank first by rating, the rest by wins; both
+// need minGames games in the window. For a season the rating is the one the
+// player held after their last rated game in it.
+func (s *Server) loadLeaderboard(from, to int64, seasonal bool, minGames int) ([]leaderboardEntry, error) {
+	rows, err := s.db.Query(
+		`SELECT u.id, u.username, COUNT(*),
+		 SUM(CASE WHEN g.is_draw = 0 AND g.winner_symbol = g.symbol THEN 1 ELSE 0 END),
+		 SUM(CASE WHEN g.is_draw = 0 AND g.winner_symbol != g.symbol THEN 1 ELSE 0 END),
+		 SUM(g.is_draw)
+		 FROM (
+			SELECT player_x_user_id AS user_id, 'X' AS symbol, winner_symbol, is_draw FROM games
+			WHERE bot_level IS NULL AND ended_at >= ? AND ended_at < ?
+			UNION ALL
+			SELECT player_o_user_id AS user_id, 'O' AS symbol, winner_symbol, is_draw FROM games
+			WHERE bot_level IS NULL AND ended_at >= ? AND ended_at < ?
+		 ) g
+		 JOIN users u ON u.id = g.user_id AND u.is_guest = 0
+		 GROUP BY u.id
+		 HAVING COUNT(*) >= ?`,
+		from, to, from, to, minGames,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []leaderboardEntry{}
+	for rows.Next() {
+		var entry leaderboardEntry
+		if err := rows.Scan(&entry.UserID, &entry.Username, &entry.Total, &entry.Wins, &entry.Losses, &entry.Draws); err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ratings, err := s.leaderboardRatings(from, to, seasonal)
+	if err != nil {
+		return nil, err
+	}
+	for i := range entries {
+		if rating, ok := ratings[entries[i].UserID]; ok {
+			entries[i].Rating = &rating
+		}
+	}
+	rankLeaderboard(entries)
+	return entries, nil
+}
+
+func (s *Server) leaderboardRatings(from, to int64, seasonal bool) (map[int64]int, error) {
+	query := "SELECT user_id, rating FROM ratings"
+	args := []any{}
+	if seasonal {
+		query = `SELECT h.user_id, h.rating_after FROM rating_history h
+			WHERE h.created_at >= ? AND h.created_at < ?
+			AND NOT EXISTS (
+				SELECT 1 FROM rating_history later
+				WHERE later.user_id = h.user_id AND later.created_at >= ? AND later.created_at < ?
+				AND (later.created_at > h.created_at OR (later.created_at = h.created_at AND later.game_id > h.game_id))
+			)`
+		args = []any{from, to, from, to}
+	}
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ratings := make(map[int64]int)
+	for rows.Next() {
+		var userID int64
+		var rating int
+		if err := rows.Scan(&userID, &rating); err != nil {
+			return nil, err
+		}
+		ratings[userID] = rating
+	}
+	return ratings, rows.Err()
+}
+
+func rankLeaderboard(entries []leaderboardEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if (a.Rating != nil) != (b.Rating != nil) {
+			return a.Rating != nil
+		}
+		if a.Rating != nil && *a.Rating != *b.Rating {
+			return *a.Rating > *b.Rating
+		}
+		if a.Wins != b.Wins {
+			return a.Wins > b.Wins
+		}
+		if a.Total != b.Total {
+			return a.Total < b.Total
+		}
+		return a.UserID < b.UserID
+	})
+	for i := range entries {
+		entries[i].Rank = i + 1
+	}
+}
+
+func (s *Server) loadSeasonStandings(seasonID int64) ([]leaderboardEntry, error) {
+	rows, err := s.db.Query(
+		`SELECT rank, user_id, username, rating, games, wins, losses, draws
+		 FROM season_standings WHERE season_id = ? ORDER BY rank`,
+		seasonID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	entries := []leaderboardEntry{}
+	for rows.Next() {
+		var entry leaderboardEntry
+		var rating sql.NullInt64
+		if err := rows.Scan(&entry.Rank, &entry.UserID, &entry.Username, &rating, &entry.Total, &entry.Wins, &entry.Losses, &entry.Draws); err != nil {
+			return nil, err
+		}
+		if rating.Valid {
+			value := int(rating.Int64)
+			entry.Rating = &value
+		}
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
+
+// runSeasons finalizes seasons as they end and keeps a monthly season open
+// when none has been defined for the current date.
+func (s *Server) runSeasons() {
+	ticker := time.NewTicker(seasonCheckInterval)
+	defer ticker.Stop()
+	for {
+		if err := s.rolloverSeasons(time.Now().UTC()); err != nil {
+			log.Printf("season rollover failed: %v", err)
+		}
+		<-ticker.C
+	}
+}
+
+func (s *Server) rolloverSeasons(now time.Time) error {
+	rows, err := s.db.Query(
+		"SELECT id, name, starts_at, ends_at, finalized_at FROM seasons WHERE finalized_at IS NULL AND ends_at <= ? ORDER BY ends_at",
+		now.Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	ended := []season{}
+	for rows.Next() {
+		current, err := scanSeason(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		ended = append(ended, current)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, current := range ended {
+		if err := s.finalizeSeason(current); err != nil {
+			return err
+		}
+		log.Printf("season %q finalized", current.Name)
+	}
+
+	if _, err := s.currentSeason(now.Unix()); !errors.Is(err, errSeasonNotFound) {
+		return err
+	}
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	start, end := month.Unix(), month.AddDate(0, 1, 0).Unix()
+	// Fit the monthly season around defined seasons that end or begin
+	// inside this month so the two never overlap.
+	var lastEnd, nextStart sql.NullInt64
+	if err := s.db.QueryRow(
+		"SELECT (SELECT MAX(ends_at) FROM seasons WHERE ends_at <= ?), (SELECT MIN(starts_at) FROM seasons WHERE starts_at > ?)",
+		now.Unix(), now.Unix(),
+	).Scan(&lastEnd, &nextStart); err != nil {
+		return err
+	}
+	if lastEnd.Valid && lastEnd.Int64 > start {
+		start = lastEnd.Int64
+	}
+	if nextStart.Valid && nextStart.Int64 < end {
+		end = nextStart.Int64
+	}
+	_, err = s.db.Exec(
+		"INSERT INTO seasons (name, starts_at, ends_at) VALUES (?, ?, ?)",
+		month.Format("2006-01"), start, end,
+	)
+	return err
+}
+
+// finalizeSeason snapshots the final standings so later changes (deleted
+// users, a different minimum) do not rewrite past champions.
+func (s *Server) finalizeSeason(current season) error {
+	entries, err := s.loadLeaderboard(current.StartsAt, current.EndsAt, true, s.leaderboardMinGames)
+	if err != nil {
+		return err
+	}
+	return withTx(s.db, func(tx *sql.Tx) error {
+		res, err := tx.Exec("UPDATE seasons SET finalized_at = ? WHERE id = ? AND finalized_at IS NULL", nowUnix(), current.ID)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil || affected == 0 {
+			return err
+		}
+		for _, entry := range entries {
+			var rating any
+			if entry.Rating != nil {
+				rating = *entry.Rating
+			}
+			if _, err := tx.Exec(
+				`INSERT INTO season_standings (season_id, rank, user_id, username, rating, games, wins, losses, draws)
+				 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				current.ID, entry.Rank, entry.UserID, entry.Username, rating, entry.Total, entry.Wins, entry.Losses, entry.Draws,
+			); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+const lobbyDebounce = 500 * time.Millisecond
+
+type lobbyPlayer struct {
+	Name      string `json:"name"`
+	Connected bool   `json:"connected"`
+	Bot       bool   `json:"bot,omitempty"`
+}
+
+type lobbyRoom struct {
+	RoomCode   string                 `json:"room_code"`
+	Variant    string                 `json:"variant"`
+	Width      int                    `json:"width"`
+	Height     int                    `json:"height"`
+	WinLength  int                    `json:"win_length"`
+	Misere     bool                   `json:"misere"`
+	Status     string                 `json:"status"`
+	Players    map[string]lobbyPlayer `json:"players"`
+	Spectators int                    `json:"spectators"`
+	Locked     bool                   `json:"locked,omitempty"`
+}
+
+type lobbyPayload struct {
+	Rooms []lobbyRoom `json:"rooms"`
+}
+
+// lobbyHub pushes the room list to subscribed sessions. Changes are coalesced
+// so a burst of moves sends one update.
+type lobbyHub struct {
+	mu          sync.Mutex
+	subscribers map[*Session]bool
+	pending     bool
+}
+
+func (s *Server) handleRooms(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, lobbyPayload{Rooms: s.lobbyRooms()}, http.StatusOK)
+}
+
+// lobbyRooms lists public rooms that are waiting for an opponent or being
+// played, waiting rooms first.
+func (s *Server) lobbyRooms() []lobbyRoom {
+	s.mu.RLock()
+	rooms := make([]*Room, 0, len(s.rooms))
+	for _, room := range s.rooms {
+		rooms = append(rooms, room)
+	}
+	s.mu.RUnlock()
+
+	listed := []lobbyRoom{}
+	for _, room := range rooms {
+		if entry, ok := room.lobbyEntry(); ok {
+			listed = append(listed, entry)
+		}
+	}
+	sort.Slice(listed, func(i, j int) bool {
+		a, b := listed[i], listed[j]
+		if (a.Status == statusWaiting) != (b.Status == statusWaiting) {
+			return a.Status == statusWaiting
+		}
+		return a.RoomCode < b.RoomCode
+	})
+	return listed
+}
+
+func (r *Room) lobbyEntry() (lobbyRoom, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.closed || r.private {
+		return lobbyRoom{}, false
+	}
+
+	state := r.snapshotLocked()
+	switch state.Status {
+	case statusWaiting, statusInProgress, statusPaused:
+	default:
+		return lobbyRoom{}, false
+	}
+
+	players := make(map[string]lobbyPlayer, len(state.Players))
+	for symbol, info := range state.Players {
+		players[symbol] = lobbyPlayer{Name: info.Name, Connected: info.Connected, Bot: info.Bot}
+	}
+	return lobbyRoom{
+		RoomCode:   state.RoomCode,
+		Variant:    state.Variant,
+		Width:      state.Width,
+		Height:     state.Height,
+		WinLength:  state.WinLength,
+		Misere:     state.Misere,
+		Status:     state.Status,
+		Players:    players,
+		Spectators: len(r.spectators),
+		Locked:     r.restrictedLocked(),
+	}, true
+}
+
+func (s *Server) subscribeLobby(session *Session) {
+	s.lobby.mu.Lock()
+	if s.lobby.subscribers == nil {
+		s.lobby.subscribers = make(map[*Session]bool)
+	}
+	s.lobby.subscribers[session] = true
+	s.lobby.mu.Unlock()
+
+	_ = session.writer.send(newMessage("lobby", lobbyPayload{Rooms: s.lobbyRooms()}))
+}
+
+func (s *Server) unsubscribeLobby(session *Session) {
+	s.lobby.mu.Lock()
+	delete(s.lobby.subscribers, session)
+	s.lobby.mu.Unlock()
+}
+
+// notifyLobby schedules a lobby update if anyone is listening.
+func (s *Server) notifyLobby() {
+	s.lobby.mu.Lock()
+	defer s.lobby.mu.Unlock()
+	if s.lobby.pending || len(s.lobby.subscribers) == 0 {
+		return
+	}
+	s.lobby.pending = true
+	time.AfterFunc(lobbyDebounce, s.flushLobby)
+}
+
+func (s *Server) flushLobby() {
+	s.lobby.mu.Lock()
+	s.lobby.pending = false
+	subscribers := make([]*Session, 0, len(s.lobby.subscribers))
+	for session := range s.lobby.subscribers {
+		subscribers = append(subscribers, session)
+	}
+	s.lobby.mu.Unlock()
+
+	if len(subscribers) == 0 {
+		return
+	}
+	msg := newMessage("lobby", lobbyPayload{Rooms: s.lobbyRooms()})
+	for _, session := range subscribers {
+		_ = session.writer.send(msg)
+	}
+}
@@ -14,6 +14,7 @@ import (
 	"path/filepath"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/websocket"
@@ -38,19 +39,9 @@ const (
 	pongWait       = 60 * time.Second
 	pingPeriod     = 50 * time.Second
 	writeWait      = 10 * time.Second
+	reconnectGrace = time.Minute
 )
 
-var winPatterns = [][]int{
-	{0, 1, 2},
-	{3, 4, 5},
-	{6, 7, 8},
-	{0, 3, 6},
-	{1, 4, 7},
-	{2, 5, 8},
-	{0, 4, 8},
-	{2, 4, 6},
-}
-
 var allowedOrigins = loadAllowedOrigins()
 
 var upgrader = websocket.Upgrader{
@@ -72,59 +63,84 @@ type outgoingMessage struct {
 }
 
 type createRoomPayload struct {
-	Name    string `json:"name"`
-	GuestID string `json:"guest_id,omitempty"`
+	Name       string  `json:"name"`
+	GuestID    string  `json:"guest_id,omitempty"`
+	Variant    string  `json:"variant,omitempty"`
+	Width      int     `json:"width,omitempty"`
+	Height     int     `json:"height,omitempty"`
+	WinLength  int     `json:"win_length,omitempty"`
+	Misere     bool    `json:"misere,omitempty"`
+	Opponent   string  `json:"opponent,omitempty"`
+	Difficulty string  `json:"difficulty,omitempty"`
+	Private    bool    `json:"private,omitempty"`
+	Password   string  `json:"password,omitempty"`
+	AllowedIDs []int64 `json:"allowed_user_ids,omitempty"`
 }
 
 type joinRoomPayload struct {
-	RoomCode  string `json:"room_code"`
-	PlayerID  string `json:"player_id,omitempty"`
-	Name      string `json:"name,omitempty"`
-	Spectator bool   `json:"spectator,omitempty"`
-	GuestID   string `json:"guest_id,omitempty"`
+	RoomCode       string `json:"room_code"`
+	PlayerID       string `json:"player_id,omitempty"`
+	ReconnectToken string `json:"reconnect_token,omitempty"`
+	Name           string `json:"name,omitempty"`
+	Spectator      bool   `json:"spectator,omitempty"`
+	GuestID        string `json:"guest_id,omitempty"`
+	Password       string `json:"password,omitempty"`
 }
 
+// movePayload and rematchPayload no longer carry a player id: actions are
+// taken for the player seated on the sending connection.
 type movePayload struct {
 	RoomCode string `json:"room_code"`
-	PlayerID string `json:"player_id"`
+	SubBoard int    `json:"sub_board,omitempty"`
 	Cell     int    `json:"cell"`
 }
 
 type rematchPayload struct {
 	RoomCode string `json:"room_code"`
-	PlayerID string `json:"player_id"`
 }
 
 type errorPayload struct {
 	Message string `json:"message"`
+	Code    string `json:"code,omitempty"`
 }
 
 type roomResponsePayload struct {
-	RoomCode    string       `json:"room_code"`
-	PlayerID    string       `json:"player_id"`
-	Symbol      string       `json:"symbol"`
-	Role        string       `json:"role"`
-	Reconnected bool         `json:"reconnected"`
-	State       statePayload `json:"state"`
+	RoomCode       string             `json:"room_code"`
+	PlayerID       string             `json:"player_id"`
+	ReconnectToken string             `json:"reconnect_token,omitempty"`
+	Symbol         string             `json:"symbol"`
+	Role           string             `json:"role"`
+	Reconnected    bool               `json:"reconnected"`
+	State          statePayload       `json:"state"`
+	HeadToHead     *headToHeadSummary `json:"head_to_head,omitempty"`
 }
 
 type playerInfo struct {
-	ID        string `json:"id"`
 	Name      string `json:"name"`
 	Connected bool   `json:"connected"`
+	Bot       bool   `json:"bot,omitempty"`
 }
 
 type statePayload struct {
-	RoomCode string                `json:"room_code"`
-	Board    []string              `json:"board"`
-	Turn     string                `json:"turn"`
-	Status   string                `json:"status"`
-	Winner   string                `json:"winner"`
-	Players  map[string]playerInfo `json:"players"`
+	RoomCode      string                  `json:"room_code"`
+	Variant       string                  `json:"variant"`
+	Board         []string                `json:"board"`
+	Width         int                     `json:"width"`
+	Height        int                     `json:"height"`
+	WinLength     int                     `json:"win_length"`
+	Misere        bool                    `json:"misere"`
+	MetaBoard     []string                `json:"meta_board,omitempty"`
+	SubWinners    []string                `json:"sub_winners,omitempty"`
+	ForcedBoard   *int                    `json:"forced_board,omitempty"`
+	Turn          string                  `json:"turn"`
+	Status        string                  `json:"status"`
+	Winner        string                  `json:"winner"`
+	Players       map[string]playerInfo   `json:"players"`
+	RatingChanges map[string]ratingChange `json:"rating_changes,omitempty"`
 }
 
 type playerLeftPayload struct {
-	PlayerID string `json:"player_id"`
+	Symbol string `json:"symbol"`
 }
 
 type roomClosedPayload struct {
@@ -136,47 +152,99 @@ type Player struct {
 	name             string
 	symbol           string
 	spectator        bool
+	bot              bool
 	userID           int64
-	conn             *websocket.Conn
+	conn             *connWriter
 	connected        bool
-	sendMu           sync.Mutex
 	disconnectTimer  *time.Timer
 	disconnectReason string
 }
 
+// connWriter is the single writer of a websocket connection. Every Player
+// made for the connection shares it, since gorilla/websocket does not allow
+// concurrent writes.
+type connWriter struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
 type Room struct {
 	code           string
-	board          [9]string
+	rules          gameRules
+	board          []string
+	subWinners     []string
+	forcedBoard    int
 	turn           string
 	startingSymbol string
 	winner         string
 	draw           bool
 	startedAt      time.Time
+	moves          []moveRecord
 	recorded       bool
+	botDifficulty  string
+	botTimer       *time.Timer
+	private        bool
+	passwordHash   string
+	allowedUserIDs []int64
+	// tournamentMatchID links the room to a tournament match; its seats are
+	// reserved for the paired users.
+	tournamentMatchID int64
 
 	playerX    *Player
 	playerO    *Player
 	spectators map[string]*Player
 
-	closed bool
-	mu     sync.Mutex
+	closed  bool
+	version int64
+	mu      sync.Mutex
+}
+
+type roomOptions struct {
+	Rules         gameRules
+	BotDifficulty string
+	Private       bool
+	Password      string
+	AllowedIDs    []int64
 }
 
 type Server struct {
-	rooms   map[string]*Room
-	mu      sync.RWMutex
-	db      *sql.DB
-	discord discordConfig
+	rooms         map[string]*Room
+	reservedCodes map[string]bool
+	mu            sync.RWMutex
+	db            *sql.DB
+	oauth         map[string]*oauthProvider
+	janitor       *janitor
+	matchmaker    *matchmaker
+	lobby         lobbyHub
+	tournaments   tournamentHub
+
+	leaderboardMinGames int
+	signingKey          []byte
+	refreshGrace        time.Duration
+	refreshReuse        atomic.Int64
 }
 
 type Session struct {
 	room   *Room
 	player *Player
 	userID *int64
+	replay *replayStream
+	closed bool
 	mu     sync.RWMutex
+
+	// writer sends what belongs to the connection rather than a room seat,
+	// such as replays, errors and the lobby and tournament feeds.
+	writer *Player
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrateCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatalf("migrate failed: %v", err)
+		}
+		return
+	}
+
 	addr := envOr("ADDR", ":8080")
 	webDir := resolveWebDir()
 	dbPath := envOr("DB_PATH", "./data/tictactoe.db")
@@ -186,26 +254,59 @@ func main() {
 		log.Fatalf("db init failed: %v", err)
 	}
 
-	discordConfig, err := loadDiscordConfig()
-	if err != nil {
-		log.Printf("discord oauth disabled: %v", err)
+	providers := loadOAuthProviders()
+	for _, name := range []string{"discord", "github", "google"} {
+		if !providers[name].configured() {
+			log.Printf("%s oauth disabled: %v", name, errOAuthNotConfigured)
+		}
 	}
 
-	srv := NewServer(db, discordConfig)
+	srv := NewServer(db, providers)
+	if srv.signingKey, err = loadSigningKey(db); err != nil {
+		log.Fatalf("signing key load failed: %v", err)
+	}
+	if restored, err := srv.restoreRooms(); err != nil {
+		log.Printf("room restore failed: %v", err)
+	} else if restored > 0 {
+		log.Printf("restored %d live rooms", restored)
+	}
+	srv.janitor = newJanitor(db, loadJanitorConfig())
+	go srv.janitor.run()
+	go srv.runMatchmaking()
+	go srv.runSeasons()
+
 	mux := http.NewServeMux()
 	mux.HandleFunc("/ws", srv.handleWS)
 	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		_, _ = w.Write([]byte("ok"))
 	})
-	mux.HandleFunc("/auth/discord/login", srv.handleDiscordLogin)
-	mux.HandleFunc("/auth/discord/callback", srv.handleDiscordCallback)
+	mux.HandleFunc("/metrics", srv.handleMetrics)
+	mux.HandleFunc("/auth/providers", srv.handleProviders)
+	mux.HandleFunc("/auth/{provider}/login", srv.handleOAuthLogin)
+	mux.HandleFunc("/auth/{provider}/callback", srv.handleOAuthCallback)
+	mux.HandleFunc("/auth/{provider}/link", srv.handleUnlinkIdentity)
 	mux.HandleFunc("/auth/refresh", srv.handleRefresh)
 	mux.HandleFunc("/auth/me", srv.handleMe)
 	mux.HandleFunc("/auth/logout", srv.handleLogout)
 	mux.HandleFunc("/auth/ws-ticket", srv.handleWSTicket)
+	mux.HandleFunc("/auth/guest", srv.handleGuest)
 	mux.HandleFunc("/api/history", srv.handleHistory)
 	mux.HandleFunc("/api/stats", srv.handleStats)
+	mux.HandleFunc("/api/head-to-head", srv.handleHeadToHead)
+	mux.HandleFunc("/api/analyze", srv.handleAnalyze)
+	mux.HandleFunc("/api/rooms", srv.handleRooms)
+	mux.HandleFunc("/api/leaderboard", srv.handleLeaderboard)
+	mux.HandleFunc("/api/seasons", srv.handleSeasons)
+	mux.HandleFunc("/api/tournaments", srv.handleTournaments)
+	mux.HandleFunc("/api/tournaments/{id}", srv.handleTournament)
+	mux.HandleFunc("/api/tournaments/{id}/register", srv.handleTournamentRegister)
+	mux.HandleFunc("/api/tournaments/{id}/start", srv.handleTournamentStart)
+	mux.HandleFunc("/api/tournaments/{id}/matches/{match}/result", srv.handleMatchResult)
+	mux.HandleFunc("/api/history/export", srv.handleHistoryExport)
+	mux.HandleFunc("/api/games/{id}", srv.handleGame)
+	mux.HandleFunc("/api/games/{id}/export", srv.handleGameExport)
+	mux.HandleFunc("/api/games/import", srv.handleGameImport)
 
 	if webDir != "" {
 		mux.Handle("/", spaHandler(webDir))
@@ -221,8 +322,16 @@ func main() {
 	}
 }
 
-func NewServer(db *sql.DB, discord discordConfig) *Server {
-	return &Server{rooms: make(map[string]*Room), db: db, discord: discord}
+func NewServer(db *sql.DB, oauth map[string]*oauthProvider) *Server {
+	return &Server{
+		rooms:               make(map[string]*Room),
+		reservedCodes:       make(map[string]bool),
+		db:                  db,
+		oauth:               oauth,
+		matchmaker:          &matchmaker{},
+		leaderboardMinGames: envInt("LEADERBOARD_MIN_GAMES", 5),
+		refreshGrace:        envDuration("REFRESH_REUSE_GRACE", 30*time.Second),
+	}
 }
 
 func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
@@ -243,7 +352,11 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 	}
 	defer conn.Close()
 
-	session := &Session{userID: userID}
+	out := &connWriter{conn: conn}
+	session := &Session{
+		userID: userID,
+		writer: &Player{id: randomID(), spectator: true, conn: out, connected: true},
+	}
 
 	conn.SetReadLimit(maxMessageSize)
 	_ = conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -261,10 +374,9 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 		for {
 			select {
 			case <-pingTicker.C:
-				player := session.getPlayer()
-				if player != nil {
-					_ = player.sendPing()
-				}
+				// The connection is pinged whether or not it holds a seat, so
+				// replay viewers and feed subscribers stay alive too.
+				_ = session.writer.sendPing()
 			case <-done:
 				return
 			}
@@ -281,88 +393,191 @@ func (s *Server) handleWS(w http.ResponseWriter, r *http.Request) {
 		case "create_room":
 			var payload createRoomPayload
 			_ = json.Unmarshal(msg.Payload, &payload)
-			room, player, err := s.createRoom(conn, payload.Name, session.getUserID(), payload.GuestID)
+			session.stopReplay()
+			s.matchmaker.remove(session)
+			options, err := roomOptionsFromPayload(payload)
 			if err != nil {
-				sendError(conn, err.Error())
+				sendError(out, err.Error())
+				continue
+			}
+			room, player, err := s.createRoom(out, payload.Name, options, session.getUserID(), payload.GuestID)
+			if err != nil {
+				sendError(out, err.Error())
 				continue
 			}
 			session.set(room, player)
 
 			response := roomResponsePayload{
-				RoomCode:    room.code,
-				PlayerID:    player.id,
-				Symbol:      player.symbol,
-				Role:        roleLabel(player),
-				Reconnected: false,
-				State:       room.snapshot(),
+				RoomCode:       room.code,
+				PlayerID:       player.id,
+				ReconnectToken: s.reconnectToken(room, player),
+				Symbol:         player.symbol,
+				Role:           roleLabel(player),
+				Reconnected:    false,
+				State:          room.snapshot(),
 			}
 			_ = player.send(newMessage("room_created", response))
 
 		case "join_room":
 			var payload joinRoomPayload
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				sendError(conn, "invalid join_room payload")
+				sendError(out, "invalid join_room payload")
 				continue
 			}
+			session.stopReplay()
+			s.matchmaker.remove(session)
 
-			room, player, reconnected, err := s.joinRoom(conn, payload.RoomCode, payload.PlayerID, payload.Name, payload.Spectator, session.getUserID(), payload.GuestID)
+			room, player, reconnected, err := s.joinRoom(out, payload.RoomCode, payload.PlayerID, payload.ReconnectToken, payload.Name, payload.Spectator, session.getUserID(), payload.GuestID, payload.Password)
 			if err != nil {
-				sendError(conn, err.Error())
+				sendJoinError(out, err)
 				continue
 			}
 
 			session.set(room, player)
+			s.saveRoom(room)
 
 			response := roomResponsePayload{
-				RoomCode:    room.code,
-				PlayerID:    player.id,
-				Symbol:      player.symbol,
-				Role:        roleLabel(player),
-				Reconnected: reconnected,
-				State:       room.snapshot(),
+				RoomCode:       room.code,
+				PlayerID:       player.id,
+				ReconnectToken: s.reconnectToken(room, player),
+				Symbol:         player.symbol,
+				Role:           roleLabel(player),
+				Reconnected:    reconnected,
+				State:          room.snapshot(),
+				HeadToHead:     s.seatedHeadToHead(room, player),
 			}
 			_ = player.send(newMessage("room_joined", response))
+			if !reconnected {
+				s.sendOpponentHeadToHead(room, player)
+			}
 
 			s.broadcastState(room)
+			s.scheduleBotMove(room)
 
 		case "move":
 			var payload movePayload
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				sendError(conn, "invalid move payload")
+				sendError(out, "invalid move payload")
 				continue
 			}
-
-			if err := s.applyMove(payload); err != nil {
-				sendError(conn, err.Error())
+			room, player, err := session.seat(payload.RoomCode)
+			if err != nil {
+				sendError(out, err.Error())
+				continue
+			}
+			if err := s.applyMove(room, player, payload); err != nil {
+				sendError(out, err.Error())
 				continue
 			}
 		case "rematch":
 			var payload rematchPayload
 			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
-				sendError(conn, "invalid rematch payload")
+				sendError(out, "invalid rematch payload")
+				continue
+			}
+			room, player, err := session.seat(payload.RoomCode)
+			if err != nil {
+				sendError(out, err.Error())
+				continue
+			}
+			if err := s.rematch(room, player); err != nil {
+				sendError(out, err.Error())
+				continue
+			}
+		case "watch_replay":
+			var payload watchReplayPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				sendError(out, "invalid watch_replay payload")
+				continue
+			}
+			if err := s.watchReplay(session, payload); err != nil {
+				sendError(out, err.Error())
+				continue
+			}
+		case "find_match":
+			var payload findMatchPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				sendError(out, "invalid find_match payload")
+				continue
+			}
+			if err := s.findMatch(session, payload); err != nil {
+				sendError(out, err.Error())
 				continue
 			}
-			if err := s.rematch(payload); err != nil {
-				sendError(conn, err.Error())
+		case "cancel_match":
+			if err := s.cancelMatch(session); err != nil {
+				sendError(out, err.Error())
 				continue
 			}
+			_ = session.writer.send(newMessage("match_cancelled", nil))
+		case "subscribe_lobby":
+			s.subscribeLobby(session)
+		case "unsubscribe_lobby":
+			s.unsubscribeLobby(session)
+		case "subscribe_tournament":
+			var payload watchTournamentPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				sendError(out, "invalid subscribe_tournament payload")
+				continue
+			}
+			if err := s.subscribeTournament(session, payload); err != nil {
+				sendError(out, err.Error())
+				continue
+			}
+		case "unsubscribe_tournament":
+			var payload watchTournamentPayload
+			if err := json.Unmarshal(msg.Payload, &payload); err != nil {
+				sendError(out, "invalid unsubscribe_tournament payload")
+				continue
+			}
+			s.unsubscribeTournament(session, payload.TournamentID)
 		default:
-			sendError(conn, "unknown message type")
+			sendError(out, "unknown message type")
 		}
 	}
 
-	room, player := session.get()
+	session.stopReplay()
+	s.matchmaker.remove(session)
+	s.unsubscribeLobby(session)
+	s.unsubscribeTournament(session, 0)
+	room, player := session.close()
 	if room != nil && player != nil {
 		s.handleDisconnect(room, player)
 	}
 }
 
-func (s *Server) createRoom(conn *websocket.Conn, name string, sessionUserID *int64, guestID string) (*Room, *Player, error) {
-	code := s.uniqueRoomCode()
+func roomOptionsFromPayload(payload createRoomPayload) (roomOptions, error) {
+	rules, err := newGameRules(payload.Variant, payload.Width, payload.Height, payload.WinLength)
+	if err != nil {
+		return roomOptions{}, err
+	}
+	rules.Misere = payload.Misere
+
+	if err := validateRoomAccess(payload.Password, payload.AllowedIDs); err != nil {
+		return roomOptions{}, err
+	}
+
+	options := roomOptions{Rules: rules, Private: payload.Private, Password: payload.Password, AllowedIDs: payload.AllowedIDs}
+	switch payload.Opponent {
+	case "", opponentHuman:
+	case opponentBot:
+		difficulty, err := normalizeBotDifficulty(payload.Difficulty)
+		if err != nil {
+			return roomOptions{}, err
+		}
+		options.BotDifficulty = difficulty
+	default:
+		return roomOptions{}, errors.New("unknown opponent")
+	}
+	return options, nil
+}
+
+func (s *Server) createRoom(conn *connWriter, name string, options roomOptions, sessionUserID *int64, guestID string) (*Room, *Player, error) {
 	userID, err := s.resolveUserID(sessionUserID, guestID, sanitizeName(name, "Joueur X"))
 	if err != nil {
 		return nil, nil, err
 	}
+	code := s.uniqueRoomCode()
 	player := &Player{
 		id:        randomID(),
 		name:      sanitizeName(name, "Joueur X"),
@@ -374,21 +589,35 @@ func (s *Server) createRoom(conn *websocket.Conn, name string, sessionUserID *in
 
 	room := &Room{
 		code:           code,
+		rules:          options.Rules,
 		turn:           symbolX,
 		startingSymbol: symbolX,
 		startedAt:      time.Now().UTC(),
 		playerX:        player,
 		spectators:     make(map[string]*Player),
+		botDifficulty:  options.BotDifficulty,
+		private:        options.Private,
+		passwordHash:   roomPasswordHash(s.signingKey, code, options.Password),
+		allowedUserIDs: options.AllowedIDs,
+	}
+	room.resetBoardLocked()
+	if options.BotDifficulty != "" {
+		room.playerO = newBotPlayer(options.BotDifficulty)
 	}
+	s.addRoom(room)
 
+	return room, player, nil
+}
+
+func (s *Server) addRoom(room *Room) {
 	s.mu.Lock()
-	s.rooms[code] = room
+	s.rooms[room.code] = room
+	delete(s.reservedCodes, room.code)
 	s.mu.Unlock()
-
-	return room, player, nil
+	s.saveRoom(room)
 }
 
-func (s *Server) joinRoom(conn *websocket.Conn, code, playerID, name string, spectator bool, sessionUserID *int64, guestID string) (*Room, *Player, bool, error) {
+func (s *Server) joinRoom(conn *connWriter, code, playerID, reconnectToken, name string, spectator bool, sessionUserID *int64, guestID, password string) (*Room, *Player, bool, error) {
 	room := s.getRoom(code)
 	if room == nil {
 		return nil, nil, false, errors.New("room not found")
@@ -407,39 +636,37 @@ func (s *Server) joinRoom(conn *websocket.Conn, code, playerID, name string, spe
 	}
 
 	if spectator {
-		return joinSpectator(room, conn, playerID, name, resolvedUserID)
+		return joinSpectator(room, conn, playerID, name, resolvedUserID, s.signingKey, password)
 	}
 
-	if playerID != "" {
-		if room.playerX != nil && room.playerX.id == playerID {
-			if room.playerX.connected {
-				return nil, nil, false, errors.New("player already connected")
-			}
-			attachPlayer(room.playerX, conn)
-			if name != "" {
-				room.playerX.name = sanitizeName(name, room.playerX.name)
-			}
-			if room.playerX.userID == 0 && resolvedUserID != 0 {
-				room.playerX.userID = resolvedUserID
-			}
-			return room, room.playerX, true, nil
+	if playerID != "" || reconnectToken != "" {
+		seat, err := room.reclaimSeatLocked(s.signingKey, reconnectToken, playerID, resolvedUserID)
+		if err != nil {
+			return nil, nil, false, err
 		}
-
-		if room.playerO != nil && room.playerO.id == playerID {
-			if room.playerO.connected {
-				return nil, nil, false, errors.New("player already connected")
-			}
-			attachPlayer(room.playerO, conn)
+		if seat != nil {
+			attachPlayer(seat, conn)
 			if name != "" {
-				room.playerO.name = sanitizeName(name, room.playerO.name)
+				seat.name = sanitizeName(name, seat.name)
 			}
-			if room.playerO.userID == 0 && resolvedUserID != 0 {
-				room.playerO.userID = resolvedUserID
+			if seat.userID == 0 && resolvedUserID != 0 {
+				seat.userID = resolvedUserID
 			}
-			return room, room.playerO, true, nil
+			room.startTournamentGameLocked()
+			return room, seat, true, nil
 		}
 	}
 
+	if seat := room.seatForUserLocked(resolvedUserID); seat != nil {
+		reconnected := seat.disconnectTimer != nil
+		attachPlayer(seat, conn)
+		room.startTournamentGameLocked()
+		return room, seat, reconnected, nil
+	}
+
+	if err := room.checkAccessLocked(s.signingKey, password, resolvedUserID); err != nil {
+		return nil, nil, false, err
+	}
 	if room.playerO != nil {
 		return nil, nil, false, errors.New("room already full")
 	}
@@ -457,7 +684,7 @@ func (s *Server) joinRoom(conn *websocket.Conn, code, playerID, name string, spe
 	return room, player, false, nil
 }
 
-func joinSpectator(room *Room, conn *websocket.Conn, spectatorID, name string, userID int64) (*Room, *Player, bool, error) {
+func joinSpectator(room *Room, conn *connWriter, spectatorID, name string, userID int64, key []byte, password string) (*Room, *Player, bool, error) {
 	if room.spectators == nil {
 		room.spectators = make(map[string]*Player)
 	}
@@ -478,6 +705,9 @@ func joinSpectator(room *Room, conn *websocket.Conn, spectatorID, name string, u
 		}
 	}
 
+	if err := room.checkAccessLocked(key, password, userID); err != nil {
+		return nil, nil, false, err
+	}
 	spectator := &Player{
 		id:        randomID(),
 		name:      sanitizeName(name, "Spectateur"),
@@ -491,35 +721,35 @@ func joinSpectator(room *Room, conn *websocket.Conn, spectatorID, name string, u
 	return room, spectator, false, nil
 }
 
-func (s *Server) applyMove(payload movePayload) error {
-	room := s.getRoom(payload.RoomCode)
-	if room == nil {
-		return errors.New("room not found")
-	}
-
-	state, recipients, record, err := room.applyMove(payload)
+func (s *Server) applyMove(room *Room, player *Player, payload movePayload) error {
+	state, recipients, record, err := room.applyMove(player, payload)
 	if err != nil {
 		return err
 	}
 
-	msg := newMessage("state", state)
-	for _, client := range recipients {
-		_ = client.send(msg)
-	}
-
+	s.saveRoom(room)
 	if record != nil {
-		if err := s.recordGame(*record); err != nil {
+		changes, err := s.recordGame(*record)
+		if err != nil {
 			log.Printf("game record failed: %v", err)
 		}
+		state.RatingChanges = changes
+	}
+
+	msg := newMessage("state", state)
+	for _, client := range recipients {
+		_ = client.send(msg)
 	}
 
+	s.scheduleBotMove(room)
 	return nil
 }
 
-func (s *Server) rematch(payload rematchPayload) error {
-	room := s.getRoom(payload.RoomCode)
-	if room == nil {
-		return errors.New("room not found")
+func (s *Server) rematch(room *Room, player *Player) error {
+	// A tournament room only replays drawn games until its match is settled;
+	// after that a new game would count for nothing and hold the room open.
+	if room.tournamentMatchID != 0 && s.tournamentMatchDone(room.tournamentMatchID) {
+		return errors.New("tournament match is over")
 	}
 
 	room.mu.Lock()
@@ -528,8 +758,7 @@ func (s *Server) rematch(payload rematchPayload) error {
 		return errors.New("room is closed")
 	}
 
-	player := room.playerByID(payload.PlayerID)
-	if player == nil {
+	if !room.seatedLocked(player) {
 		room.mu.Unlock()
 		return errors.New("player not found in room")
 	}
@@ -547,10 +776,30 @@ func (s *Server) rematch(payload rematchPayload) error {
 	room.resetGameLocked()
 	room.mu.Unlock()
 
+	s.saveRoom(room)
 	s.broadcastState(room)
+	s.scheduleBotMove(room)
 	return nil
 }
 
+// leaveAsSpectator takes a spectator out of its room without closing the
+// connection, which stays with the session.
+func (s *Server) leaveAsSpectator(room *Room, player *Player) {
+	room.mu.Lock()
+	if room.closed || !player.connected {
+		room.mu.Unlock()
+		return
+	}
+	player.connected = false
+	player.conn = nil
+	if room.spectators != nil {
+		delete(room.spectators, player.id)
+	}
+	room.mu.Unlock()
+	s.saveRoom(room)
+	s.broadcastState(room)
+}
+
 func (s *Server) handleDisconnect(room *Room, player *Player) {
 	room.mu.Lock()
 	if room.closed {
@@ -574,17 +823,21 @@ func (s *Server) handleDisconnect(room *Room, player *Player) {
 			delete(room.spectators, player.id)
 		}
 		room.mu.Unlock()
+		s.saveRoom(room)
 		s.broadcastState(room)
 		return
 	}
 
-	if player.disconnectTimer == nil {
-		player.disconnectTimer = time.AfterFunc(time.Minute, func() {
+	// Tournament seats stay reserved until the match is played; the organizer
+	// settles no-shows.
+	tournamentPending := room.tournamentMatchID != 0 && !room.recorded
+	if player.disconnectTimer == nil && !tournamentPending {
+		player.disconnectTimer = time.AfterFunc(reconnectGrace, func() {
 			s.closeRoom(room, "timeout")
 		})
 	}
 
-	bothDisconnected := !playerConnected(room.playerX) && !playerConnected(room.playerO)
+	bothDisconnected := !playerConnected(room.playerX) && !playerConnected(room.playerO) && !tournamentPending
 	room.mu.Unlock()
 
 	if bothDisconnected {
@@ -592,7 +845,7 @@ func (s *Server) handleDisconnect(room *Room, player *Player) {
 		return
 	}
 
-	s.sendToRoom(room, newMessage("player_left", playerLeftPayload{PlayerID: player.id}))
+	s.sendToRoom(room, newMessage("player_left", playerLeftPayload{Symbol: player.symbol}))
 	s.broadcastState(room)
 }
 
@@ -603,6 +856,10 @@ func (s *Server) closeRoom(room *Room, reason string) {
 		return
 	}
 	room.closed = true
+	if room.botTimer != nil {
+		room.botTimer.Stop()
+		room.botTimer = nil
+	}
 
 	players := []*Player{room.playerX, room.playerO}
 	for _, spectator := range room.spectators {
@@ -631,6 +888,8 @@ func (s *Server) closeRoom(room *Room, reason string) {
 	s.mu.Lock()
 	delete(s.rooms, room.code)
 	s.mu.Unlock()
+	s.deleteRoomState(room.code)
+	s.notifyLobby()
 }
 
 func (s *Server) sendToRoom(room *Room, msg outgoingMessage) {
@@ -647,9 +906,10 @@ func (s *Server) broadcastState(room *Room) {
 	for _, client := range recipients {
 		_ = client.send(msg)
 	}
+	s.notifyLobby()
 }
 
-func (r *Room) applyMove(payload movePayload) (statePayload, []*Player, *gameRecord, error) {
+func (r *Room) applyMove(player *Player, payload movePayload) (statePayload, []*Player, *gameRecord, error) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -657,12 +917,11 @@ func (r *Room) applyMove(payload movePayload) (statePayload, []*Player, *gameRec
 		return statePayload{}, nil, nil, errors.New("room is closed")
 	}
 
-	if payload.Cell < 0 || payload.Cell > 8 {
+	if !r.moveInRange(payload) {
 		return statePayload{}, nil, nil, errors.New("invalid cell")
 	}
 
-	player := r.playerByID(payload.PlayerID)
-	if player == nil {
+	if !r.seatedLocked(player) {
 		return statePayload{}, nil, nil, errors.New("player not found in room")
 	}
 
@@ -682,11 +941,16 @@ func (r *Room) applyMove(payload movePayload) (statePayload, []*Player, *gameRec
 		return statePayload{}, nil, nil, errors.New("not your turn")
 	}
 
-	if r.board[payload.Cell] != "" {
-		return statePayload{}, nil, nil, errors.New("cell already taken")
+	if err := r.placeLocked(player.symbol, payload); err != nil {
+		return statePayload{}, nil, nil, err
 	}
-
-	r.board[payload.Cell] = player.symbol
+	r.moves = append(r.moves, moveRecord{
+		Ply:       len(r.moves) + 1,
+		Symbol:    player.symbol,
+		SubBoard:  payload.SubBoard,
+		Cell:      payload.Cell,
+		ElapsedMs: time.Since(r.startedAt).Milliseconds(),
+	})
 
 	if winner := r.checkWinner(); winner != "" {
 		r.winner = winner
@@ -723,8 +987,8 @@ func (r *Room) snapshotWithPlayers() (statePayload, []*Player) {
 }
 
 func (r *Room) snapshotLocked() statePayload {
-	board := make([]string, 9)
-	copy(board, r.board[:])
+	board := make([]string, len(r.board))
+	copy(board, r.board)
 
 	status := statusWaiting
 	if r.winner != "" {
@@ -741,20 +1005,35 @@ func (r *Room) snapshotLocked() statePayload {
 
 	players := make(map[string]playerInfo)
 	if r.playerX != nil {
-		players[symbolX] = playerInfo{ID: r.playerX.id, Name: r.playerX.name, Connected: r.playerX.connected}
+		players[symbolX] = playerInfo{Name: r.playerX.name, Connected: r.playerX.connected, Bot: r.playerX.bot}
 	}
 	if r.playerO != nil {
-		players[symbolO] = playerInfo{ID: r.playerO.id, Name: r.playerO.name, Connected: r.playerO.connected}
-	}
-
-	return statePayload{
-		RoomCode: r.code,
-		Board:    board,
-		Turn:     r.turn,
-		Status:   status,
-		Winner:   r.winner,
-		Players:  players,
+		players[symbolO] = playerInfo{Name: r.playerO.name, Connected: r.playerO.connected, Bot: r.playerO.bot}
+	}
+
+	state := statePayload{
+		RoomCode:  r.code,
+		Variant:   r.rules.Variant,
+		Board:     board,
+		Width:     r.rules.Width,
+		Height:    r.rules.Height,
+		WinLength: r.rules.WinLength,
+		Misere:    r.rules.Misere,
+		Turn:      r.turn,
+		Status:    status,
+		Winner:    r.winner,
+		Players:   players,
+	}
+	if r.rules.Variant == variantUltimate {
+		state.MetaBoard = r.metaBoardLocked()
+		state.SubWinners = make([]string, len(r.subWinners))
+		copy(state.SubWinners, r.subWinners)
+		if r.forcedBoard != noForcedBoard && status != statusWin && status != statusDraw {
+			forced := r.forcedBoard
+			state.ForcedBoard = &forced
+		}
 	}
+	return state
 }
 
 func (r *Room) connectedClientsLocked() []*Player {
@@ -773,42 +1052,58 @@ func (r *Room) connectedClientsLocked() []*Player {
 	return clients
 }
 
-func (r *Room) playerByID(id string) *Player {
-	if r.playerX != nil && r.playerX.id == id {
-		return r.playerX
+// seatedLocked reports whether player currently holds one of the room's seats.
+func (r *Room) seatedLocked(player *Player) bool {
+	return player != nil && (player == r.playerX || player == r.playerO)
+}
+
+func (r *Room) moveInRange(payload movePayload) bool {
+	if r.rules.Variant == variantUltimate {
+		return payload.SubBoard >= 0 && payload.SubBoard < ultimateBoards && payload.Cell >= 0 && payload.Cell < ultimateCells
 	}
-	if r.playerO != nil && r.playerO.id == id {
-		return r.playerO
+	return payload.Cell >= 0 && payload.Cell < len(r.board)
+}
+
+func (r *Room) placeLocked(symbol string, payload movePayload) error {
+	if r.rules.Variant == variantUltimate {
+		return r.placeUltimateLocked(symbol, payload.SubBoard, payload.Cell)
 	}
+	if r.board[payload.Cell] != "" {
+		return errors.New("cell already taken")
+	}
+	r.board[payload.Cell] = symbol
 	return nil
 }
 
 func (r *Room) checkWinner() string {
-	for _, pattern := range winPatterns {
-		first := r.board[pattern[0]]
-		if first == "" {
-			continue
-		}
-		if first == r.board[pattern[1]] && first == r.board[pattern[2]] {
-			return first
-		}
+	var line string
+	if r.rules.Variant == variantUltimate {
+		line = findWinner(r.metaBoardLocked(), defaultBoardSize, defaultBoardSize, defaultBoardSize)
+	} else {
+		line = findWinner(r.board, r.rules.Width, r.rules.Height, r.rules.WinLength)
 	}
-	return ""
+	return r.rules.winnerFromLine(line)
 }
 
 func (r *Room) checkDraw() bool {
-	for _, cell := range r.board {
-		if cell == "" {
-			return false
-		}
+	if r.rules.Variant == variantUltimate {
+		return r.allSubBoardsDecidedLocked()
 	}
-	return true
+	return boardFull(r.board)
 }
 
-func (r *Room) resetGameLocked() {
-	for i := range r.board {
-		r.board[i] = ""
+func (r *Room) resetBoardLocked() {
+	r.board = r.rules.newBoard()
+	r.subWinners = nil
+	r.forcedBoard = noForcedBoard
+	if r.rules.Variant == variantUltimate {
+		r.subWinners = make([]string, ultimateBoards)
 	}
+}
+
+func (r *Room) resetGameLocked() {
+	r.resetBoardLocked()
+	r.moves = nil
 	if r.startingSymbol == "" {
 		r.startingSymbol = symbolX
 	} else {
@@ -821,7 +1116,7 @@ func (r *Room) resetGameLocked() {
 	r.startedAt = time.Now().UTC()
 }
 
-func attachPlayer(player *Player, conn *websocket.Conn) {
+func attachPlayer(player *Player, conn *connWriter) {
 	player.conn = conn
 	player.connected = true
 	if player.disconnectTimer != nil {
@@ -831,21 +1126,34 @@ func attachPlayer(player *Player, conn *websocket.Conn) {
 }
 
 func playerConnected(player *Player) bool {
+	if player != nil && player.bot {
+		return player.connected
+	}
 	return player != nil && player.connected && player.conn != nil
 }
 
+// uniqueRoomCode reserves a code until addRoom stores its room, so callers
+// drawing codes at the same time never get the same one.
 func (s *Server) uniqueRoomCode() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for {
 		code := randomRoomCode()
-		s.mu.RLock()
-		_, exists := s.rooms[code]
-		s.mu.RUnlock()
-		if !exists {
+		if _, exists := s.rooms[code]; !exists && !s.reservedCodes[code] {
+			s.reservedCodes[code] = true
 			return code
 		}
 	}
 }
 
+func (s *Server) releaseRoomCodes(codes []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, code := range codes {
+		delete(s.reservedCodes, code)
+	}
+}
+
 func (s *Server) getRoom(code string) *Room {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -856,20 +1164,32 @@ func (p *Player) send(msg outgoingMessage) error {
 	if p == nil || !p.connected || p.conn == nil {
 		return nil
 	}
-	p.sendMu.Lock()
-	defer p.sendMu.Unlock()
-	_ = p.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	return p.conn.WriteJSON(msg)
+	return p.conn.writeJSON(msg)
 }
 
 func (p *Player) sendPing() error {
 	if p == nil || !p.connected || p.conn == nil {
 		return nil
 	}
-	p.sendMu.Lock()
-	defer p.sendMu.Unlock()
-	_ = p.conn.SetWriteDeadline(time.Now().Add(writeWait))
-	return p.conn.WriteMessage(websocket.PingMessage, []byte("ping"))
+	return p.conn.writePing()
+}
+
+func (c *connWriter) writeJSON(msg outgoingMessage) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteJSON(msg)
+}
+
+func (c *connWriter) writePing() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_ = c.conn.SetWriteDeadline(time.Now().Add(writeWait))
+	return c.conn.WriteMessage(websocket.PingMessage, []byte("ping"))
+}
+
+func (c *connWriter) Close() error {
+	return c.conn.Close()
 }
 
 func newMessage(msgType string, payload any) outgoingMessage {
@@ -880,8 +1200,8 @@ func newMessage(msgType string, payload any) outgoingMessage {
 	return outgoingMessage{Type: msgType, Payload: data}
 }
 
-func sendError(conn *websocket.Conn, msg string) {
-	_ = conn.WriteJSON(newMessage("error", errorPayload{Message: msg}))
+func sendError(conn *connWriter, msg string) {
+	_ = conn.writeJSON(newMessage("error", errorPayload{Message: msg}))
 }
 
 func otherSymbol(symbol string) string {
@@ -1054,6 +1374,32 @@ func (s *Session) set(room *Room, player *Player) {
 	s.player = player
 }
 
+// setIfOpen seats the session unless its connection has already gone away.
+func (s *Session) setIfOpen(room *Room, player *Player) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		return false
+	}
+	s.room = room
+	s.player = player
+	return true
+}
+
+// close marks the connection gone and returns the seat it held.
+func (s *Session) close() (*Room, *Player) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.room, s.player
+}
+
+func (s *Session) isClosed() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.closed
+}
+
 func (s *Session) getUserID() *int64 {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
@@ -1071,3 +1417,17 @@ func (s *Session) get() (*Room, *Player) {
 	defer s.mu.RUnlock()
 	return s.room, s.player
 }
+
+// seat returns the room and player this connection is seated as. Game actions
+// are authorized against it rather than any id the client sends; roomCode,
+// when given, must name that room.
+func (s *Session) seat(roomCode string) (*Room, *Player, error) {
+	room, player := s.get()
+	if room == nil || player == nil || player.spectator || player.bot {
+		return nil, nil, errors.New("not seated in a room")
+	}
+	if roomCode != "" && !strings.EqualFold(roomCode, room.code) {
+		return nil, nil, errors.New("not seated in that room")
+	}
+	return room, player, nil
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+const (
+	matchmakingTick      = 2 * time.Second
+	baseRatingBand       = 100
+	ratingBandStep       = 50
+	ratingBandStepPeriod = 5 * time.Second
+)
+
+type findMatchPayload struct {
+	Name      string `json:"name"`
+	GuestID   string `json:"guest_id,omitempty"`
+	Variant   string `json:"variant,omitempty"`
+	Width     int    `json:"width,omitempty"`
+	Height    int    `json:"height,omitempty"`
+	WinLength int    `json:"win_length,omitempty"`
+	Misere    bool   `json:"misere,omitempty"`
+}
+
+type matchQueuedPayload struct {
+	Variant   string `json:"variant"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	WinLength int    `json:"win_length"`
+	Misere    bool   `json:"misere"`
+	Rating    *int   `json:"rating,omitempty"`
+}
+
+// matchTicket is one session waiting in the queue. rating is nil for players
+// without a rating, who are paired first come, first served.
+type matchTicket struct {
+	session  *Session
+	conn     *connWriter
+	name     string
+	userID   int64
+	rating   *int
+	rules    gameRules
+	queuedAt time.Time
+}
+
+type matchmaker struct {
+	mu    sync.Mutex
+	queue []*matchTicket
+}
+
+func (s *Server) findMatch(session *Session, payload findMatchPayload) error {
+	rules, err := newGameRules(payload.Variant, payload.Width, payload.Height, payload.WinLength)
+	if err != nil {
+		return err
+	}
+	rules.Misere = payload.Misere
+
+	room, player := session.get()
+	if room != nil && player != nil {
+		room.mu.Lock()
+		live := !room.closed && player.connected
+		room.mu.Unlock()
+		if live && !player.spectator {
+			return errors.New("leave your seat before finding a match")
+		}
+		if live {
+			s.leaveAsSpectator(room, player)
+		}
+		session.set(nil, nil)
+	}
+
+	name := sanitizeName(payload.Name, "Joueur")
+	userID, err := s.resolveUserID(session.getUserID(), payload.GuestID, name)
+	if err != nil {
+		return err
+	}
+	ticket := &matchTicket{
+		session:  session,
+		conn:     session.writer.conn,
+		name:     name,
+		userID:   userID,
+		rules:    rules,
+		queuedAt: time.Now(),
+	}
+	if userID != 0 {
+		info, err := s.loadRating(userID)
+		if err != nil {
+			log.Printf("matchmaking rating load failed: %v", err)
+		} else if info != nil {
+			ticket.rating = &info.Rating
+		}
+	}
+
+	s.matchmaker.enqueue(ticket)
+	_ = session.writer.send(newMessage("match_queued", matchQueuedPayload{
+		Variant:   rules.Variant,
+		Width:     rules.Width,
+		Height:    rules.Height,
+		WinLength: rules.WinLength,
+		Misere:    rules.Misere,
+		Rating:    ticket.rating,
+	}))
+	s.pairMatches()
+	return nil
+}
+
+func (s *Server) cancelMatch(session *Session) error {
+	if !s.matchmaker.remove(session) {
+		return errors.New("not in matchmaking queue")
+	}
+	return nil
+}
+
+// runMatchmaking re-runs pairing periodically so rating bands widen for
+// players who keep waiting.
+func (s *Server) runMatchmaking() {
+	ticker := time.NewTicker(matchmakingTick)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.pairMatches()
+	}
+}
+
+func (s *Server) pairMatches() {
+	for _, pair := range s.matchmaker.takePairs(time.Now()) {
+		s.startMatch(pair[0], pair[1])
+	}
+}
+
+// startMatch seats both tickets in a new room with a random X and sends each
+// one a match_found carrying the usual room response. A ticket whose
+// connection closed since it was queued is dropped and its partner queued
+// again.
+func (s *Server) startMatch(a, b *matchTicket) {
+	if a.session.isClosed() || b.session.isClosed() {
+		for _, ticket := range []*matchTicket{a, b} {
+			if !ticket.session.isClosed() {
+				s.matchmaker.enqueue(ticket)
+			}
+		}
+		return
+	}
+	if rand.IntN(2) == 1 {
+		a, b = b, a
+	}
+	playerX := &Player{id: randomID(), name: a.name, symbol: symbolX, userID: a.userID, conn: a.conn, connected: true}
+	playerO := &Player{id: randomID(), name: b.name, symbol: symbolO, userID: b.userID, conn: b.conn, connected: true}
+
+	room := &Room{
+		code:           s.uniqueRoomCode(),
+		rules:          a.rules,
+		turn:           symbolX,
+		startingSymbol: symbolX,
+		startedAt:      time.Now().UTC(),
+		playerX:        playerX,
+		playerO:        playerO,
+		spectators:     make(map[string]*Player),
+	}
+	room.resetBoardLocked()
+	s.addRoom(room)
+
+	for _, seat := range []struct {
+		ticket *matchTicket
+		player *Player
+	}{{a, playerX}, {b, playerO}} {
+		seat.ticket.session.stopReplay()
+		if !seat.ticket.session.setIfOpen(room, seat.player) {
+			// Closed after the check above: treat it as a disconnect so the
+			// usual grace timer cleans the room up.
+			s.handleDisconnect(room, seat.player)
+			continue
+		}
+		response := roomResponsePayload{
+			RoomCode:       room.code,
+			PlayerID:       seat.player.id,
+			ReconnectToken: s.reconnectToken(room, seat.player),
+			Symbol:         seat.player.symbol,
+			Role:           roleLabel(seat.player),
+			Reconnected:    false,
+			State:          room.snapshot(),
+			HeadToHead:     s.seatedHeadToHead(room, seat.player),
+		}
+		_ = seat.player.send(newMessage("match_found", response))
+	}
+	s.broadcastState(room)
+}
+
+// enqueue adds the ticket, replacing any earlier ticket from the same session.
+func (m *matchmaker) enqueue(ticket *matchTicket) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.removeLocked(ticket.session)
+	m.queue = append(m.queue, ticket)
+}
+
+func (m *matchmaker) remove(session *Session) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removeLocked(session)
+}
+
+func (m *matchmaker) removeLocked(session *Session) bool {
+	for i, ticket := range m.queue {
+		if ticket.session == session {
+			m.queue = append(m.queue[:i], m.queue[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// takePairs removes and returns every pair that can be matched now, oldest
+// tickets first.
+func (m *matchmaker) takePairs(now time.Time) [][2]*matchTicket {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	pairs := [][2]*matchTicket{}
+	taken := make(map[*matchTicket]bool)
+	for i, a := range m.queue {
+		if taken[a] {
+			continue
+		}
+		for _, b := range m.queue[i+1:] {
+			if !taken[b] && a.canPlay(b, now) {
+				taken[a], taken[b] = true, true
+				pairs = append(pairs, [2]*matchTicket{a, b})
+				break
+			}
+		}
+	}
+
+	remaining := m.queue[:0]
+	for _, ticket := range m.queue {
+		if !taken[ticket] {
+			remaining = append(remaining, ticket)
+		}
+	}
+	m.queue = remaining
+	return pairs
+}
+
+func (t *matchTicket) canPlay(other *matchTicket, now time.Time) bool {
+	if t.rules != other.rules {
+		return false
+	}
+	if t.userID != 0 && t.userID == other.userID {
+		return false
+	}
+	if t.rating == nil || other.rating == nil {
+		return true
+	}
+	diff := *t.rating - *other.rating
+	if diff < 0 {
+		diff = -diff
+	}
+	return diff <= max(t.ratingBand(now), other.ratingBand(now))
+}
+
+// ratingBand is how far apart two ratings may be; it grows the longer the
+// ticket has been waiting.
+func (t *matchTicket) ratingBand(now time.Time) int {
+	steps := int(now.Sub(t.queuedAt) / ratingBandStepPeriod)
+	return baseRatingBand + steps*ratingBandStep
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+type migration struct {
+	version int
+	name    string
+	up      func(tx *sql.Tx) error
+	down    func(tx *sql.Tx) error
+}
+
+type migrationStatus struct {
+	Version   int
+	Name      string
+	AppliedAt int64
+}
+
+// migrations is the ordered schema history. Append new entries; never edit or
+// renumber one that has shipped. Version 1 uses IF NOT EXISTS so databases
+// created before versioning adopt it in place.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial_schema",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS users (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				discord_id TEXT UNIQUE,
+				guest_id TEXT UNIQUE,
+				username TEXT NOT NULL,
+				avatar TEXT,
+				is_guest INTEGER NOT NULL DEFAULT 1,
+				created_at INTEGER NOT NULL
+			);`,
+			`CREATE TABLE IF NOT EXISTS sessions (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				access_token_hash TEXT NOT NULL,
+				access_expires_at INTEGER NOT NULL,
+				refresh_token_hash TEXT NOT NULL,
+				refresh_expires_at INTEGER NOT NULL,
+				created_at INTEGER NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			);`,
+			`CREATE TABLE IF NOT EXISTS ws_tickets (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				user_id INTEGER NOT NULL,
+				ticket_hash TEXT NOT NULL,
+				expires_at INTEGER NOT NULL,
+				used INTEGER NOT NULL DEFAULT 0,
+				created_at INTEGER NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			);`,
+			`CREATE TABLE IF NOT EXISTS games (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				room_code TEXT NOT NULL,
+				started_at INTEGER NOT NULL,
+				ended_at INTEGER NOT NULL,
+				winner_symbol TEXT,
+				is_draw INTEGER NOT NULL DEFAULT 0,
+				player_x_user_id INTEGER,
+				player_o_user_id INTEGER,
+				player_x_name TEXT,
+				player_o_name TEXT,
+				FOREIGN KEY(player_x_user_id) REFERENCES users(id),
+				FOREIGN KEY(player_o_user_id) REFERENCES users(id)
+			);`,
+			"CREATE INDEX IF NOT EXISTS idx_sessions_access ON sessions(access_token_hash);",
+			"CREATE INDEX IF NOT EXISTS idx_sessions_refresh ON sessions(refresh_token_hash);",
+			"CREATE INDEX IF NOT EXISTS idx_ws_ticket_hash ON ws_tickets(ticket_hash);",
+			"CREATE INDEX IF NOT EXISTS idx_games_player_x ON games(player_x_user_id);",
+			"CREATE INDEX IF NOT EXISTS idx_games_player_o ON games(player_o_user_id);",
+		),
+	},
+	{
+		version: 2,
+		name:    "game_rules",
+		up: addColumns("games",
+			columnDef{"variant", "TEXT NOT NULL DEFAULT 'classic'"},
+			columnDef{"width", "INTEGER NOT NULL DEFAULT 3"},
+			columnDef{"height", "INTEGER NOT NULL DEFAULT 3"},
+			columnDef{"win_length", "INTEGER NOT NULL DEFAULT 3"},
+			columnDef{"misere", "INTEGER NOT NULL DEFAULT 0"},
+			columnDef{"bot_level", "TEXT"},
+		),
+		down: execStatements(
+			"ALTER TABLE games DROP COLUMN bot_level;",
+			"ALTER TABLE games DROP COLUMN misere;",
+			"ALTER TABLE games DROP COLUMN win_length;",
+			"ALTER TABLE games DROP COLUMN height;",
+			"ALTER TABLE games DROP COLUMN width;",
+			"ALTER TABLE games DROP COLUMN variant;",
+		),
+	},
+	{
+		version: 3,
+		name:    "game_moves",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS game_moves (
+				game_id INTEGER NOT NULL,
+				ply INTEGER NOT NULL,
+				symbol TEXT NOT NULL,
+				sub_board INTEGER NOT NULL DEFAULT 0,
+				cell INTEGER NOT NULL,
+				elapsed_ms INTEGER NOT NULL,
+				PRIMARY KEY(game_id, ply),
+				FOREIGN KEY(game_id) REFERENCES games(id) ON DELETE CASCADE
+			);`,
+		),
+		down: execStatements("DROP TABLE game_moves;"),
+	},
+	{
+		version: 4,
+		name:    "live_rooms",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS live_rooms (
+				code TEXT PRIMARY KEY,
+				version INTEGER NOT NULL,
+				state TEXT NOT NULL,
+				updated_at INTEGER NOT NULL
+			);`,
+		),
+		down: execStatements("DROP TABLE live_rooms;"),
+	},
+	{
+		version: 5,
+		name:    "janitor_indexes",
+		up: execStatements(
+			"CREATE INDEX IF NOT EXISTS idx_sessions_refresh_expires ON sessions(refresh_expires_at);",
+			"CREATE INDEX IF NOT EXISTS idx_ws_tickets_expires ON ws_tickets(expires_at);",
+		),
+		down: execStatements(
+			"DROP INDEX idx_sessions_refresh_expires;",
+			"DROP INDEX idx_ws_tickets_expires;",
+		),
+	},
+	{
+		version: 6,
+		name:    "history_indexes",
+		up: execStatements(
+			"CREATE INDEX IF NOT EXISTS idx_games_player_x_ended ON games(player_x_user_id, ended_at, id);",
+			"CREATE INDEX IF NOT EXISTS idx_games_player_o_ended ON games(player_o_user_id, ended_at, id);",
+		),
+		down: execStatements(
+			"DROP INDEX idx_games_player_x_ended;",
+			"DROP INDEX idx_games_player_o_ended;",
+		),
+	},
+	{
+		version: 7,
+		name:    "ratings",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS ratings (
+				user_id INTEGER PRIMARY KEY,
+				rating INTEGER NOT NULL,
+				games INTEGER NOT NULL DEFAULT 0,
+				updated_at INTEGER NOT NULL,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			);`,
+			`CREATE TABLE IF NOT EXISTS rating_history (
+				game_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				rating_before INTEGER NOT NULL,
+				rating_after INTEGER NOT NULL,
+				created_at INTEGER NOT NULL,
+				PRIMARY KEY(game_id, user_id),
+				FOREIGN KEY(game_id) REFERENCES games(id) ON DELETE CASCADE,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			);`,
+			"CREATE INDEX IF NOT EXISTS idx_rating_history_user ON rating_history(user_id, created_at);",
+		),
+		down: execStatements(
+			"DROP TABLE rating_history;",
+			"DROP TABLE ratings;",
+		),
+	},
+	{
+		version: 8,
+		name:    "tournaments",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS tournaments (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				format TEXT NOT NULL,
+				status TEXT NOT NULL,
+				variant TEXT NOT NULL,
+				width INTEGER NOT NULL,
+				height INTEGER NOT NULL,
+				win_length INTEGER NOT NULL,
+				misere INTEGER NOT NULL DEFAULT 0,
+				max_players INTEGER NOT NULL,
+				rounds INTEGER NOT NULL DEFAULT 0,
+				current_round INTEGER NOT NULL DEFAULT 0,
+				created_by INTEGER NOT NULL,
+				created_at INTEGER NOT NULL,
+				started_at INTEGER,
+				finished_at INTEGER,
+				FOREIGN KEY(created_by) REFERENCES users(id) ON DELETE CASCADE
+			);`,
+			`CREATE TABLE IF NOT EXISTS tournament_players (
+				tournament_id INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				name TEXT NOT NULL,
+				seed INTEGER NOT NULL DEFAULT 0,
+				registered_at INTEGER NOT NULL,
+				PRIMARY KEY(tournament_id, user_id),
+				FOREIGN KEY(tournament_id) REFERENCES tournaments(id) ON DELETE CASCADE,
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			);`,
+			`CREATE TABLE IF NOT EXISTS tournament_matches (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				tournament_id INTEGER NOT NULL,
+				round INTEGER NOT NULL,
+				slot INTEGER NOT NULL,
+				player_x_user_id INTEGER NOT NULL,
+				player_o_user_id INTEGER,
+				room_code TEXT,
+				game_id INTEGER,
+				winner_user_id INTEGER,
+				is_draw INTEGER NOT NULL DEFAULT 0,
+				status TEXT NOT NULL,
+				created_at INTEGER NOT NULL,
+				finished_at INTEGER,
+				UNIQUE(tournament_id, round, slot),
+				FOREIGN KEY(tournament_id) REFERENCES tournaments(id) ON DELETE CASCADE,
+				FOREIGN KEY(game_id) REFERENCES games(id) ON DELETE SET NULL
+			);`,
+		),
+		down: execStatements(
+			"DROP TABLE tournament_matches;",
+			"DROP TABLE tournament_players;",
+			"DROP TABLE tournaments;",
+		),
+	},
+	{
+		version: 9,
+		name:    "seasons",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS seasons (
+				id INTEGER PRIMARY KEY AUTOINCREMENT,
+				name TEXT NOT NULL,
+				starts_at INTEGER NOT NULL,
+				ends_at INTEGER NOT NULL,
+				finalized_at INTEGER
+			);`,
+			"CREATE INDEX IF NOT EXISTS idx_seasons_range ON seasons(starts_at, ends_at);",
+			`CREATE TABLE IF NOT EXISTS season_standings (
+				season_id INTEGER NOT NULL,
+				rank INTEGER NOT NULL,
+				user_id INTEGER NOT NULL,
+				username TEXT NOT NULL,
+				rating INTEGER,
+				games INTEGER NOT NULL,
+				wins INTEGER NOT NULL,
+				losses INTEGER NOT NULL,
+				draws INTEGER NOT NULL,
+				PRIMARY KEY(season_id, user_id),
+				FOREIGN KEY(season_id) REFERENCES seasons(id) ON DELETE CASCADE
+			);`,
+			"CREATE INDEX IF NOT EXISTS idx_games_ended ON games(ended_at);",
+		),
+		down: execStatements(
+			"DROP INDEX idx_games_ended;",
+			"DROP TABLE season_standings;",
+			"DROP TABLE seasons;",
+		),
+	},
+	{
+		version: 10,
+		name:    "server_keys",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS server_keys (
+				name TEXT PRIMARY KEY,
+				value TEXT NOT NULL,
+				created_at INTEGER NOT NULL
+			);`,
+		),
+		down: execStatements("DROP TABLE server_keys;"),
+	},
+	{
+		version: 11,
+		name:    "guest_claims",
+		up: addColumns("users",
+			columnDef{"guest_claimed_at", "INTEGER"},
+		),
+		down: execStatements("ALTER TABLE users DROP COLUMN guest_claimed_at;"),
+	},
+	{
+		version: 12,
+		name:    "identities",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS identities (
+				provider TEXT NOT NULL,
+				subject TEXT NOT NULL,
+				user_id INTEGER NOT NULL,
+				username TEXT NOT NULL,
+				avatar TEXT,
+				created_at INTEGER NOT NULL,
+				last_login_at INTEGER NOT NULL,
+				PRIMARY KEY(provider, subject),
+				FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE
+			);`,
+			"CREATE UNIQUE INDEX IF NOT EXISTS idx_identities_user ON identities(user_id, provider);",
+			`INSERT OR IGNORE INTO identities (provider, subject, user_id, username, avatar, created_at, last_login_at)
+				SELECT 'discord', discord_id, id, username, avatar, created_at, created_at
+				FROM users WHERE discord_id IS NOT NULL AND discord_id <> '';`,
+		),
+		// users.discord_id is no longer written; going back refills it for
+		// accounts that signed up after the upgrade.
+		down: execStatements(
+			`UPDATE users SET discord_id = (
+				SELECT subject FROM identities WHERE identities.user_id = users.id AND provider = 'discord'
+			) WHERE discord_id IS NULL;`,
+			"DROP TABLE identities;",
+		),
+	},
+	{
+		version: 13,
+		name:    "refresh_token_families",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS rotated_refresh_tokens (
+				token_hash TEXT PRIMARY KEY,
+				session_id INTEGER NOT NULL,
+				rotated_at INTEGER NOT NULL,
+				successor TEXT,
+				FOREIGN KEY(session_id) REFERENCES sessions(id) ON DELETE CASCADE
+			);`,
+			"CREATE INDEX IF NOT EXISTS idx_rotated_refresh_session ON rotated_refresh_tokens(session_id);",
+		),
+		down: execStatements("DROP TABLE rotated_refresh_tokens;"),
+	},
+	{
+		version: 14,
+		name:    "game_importers",
+		up: addColumns("games",
+			columnDef{"imported_by", "INTEGER"},
+		),
+		down: execStatements("ALTER TABLE games DROP COLUMN imported_by;"),
+	},
+	{
+		version: 15,
+		name:    "guest_last_seen",
+		up: addColumns("users",
+			columnDef{"last_seen_at", "INTEGER"},
+		),
+		down: execStatements("ALTER TABLE users DROP COLUMN last_seen_at;"),
+	},
+	{
+		version: 16,
+		name:    "session_access_tokens",
+		up: execStatements(
+			`CREATE TABLE IF NOT EXISTS session_access_tokens (
+				token_hash TEXT PRIMARY KEY,
+				session_id INTEGER NOT NULL,
+				expires_at INTEGER NOT NULL,
+				FOREIGN KEY(session_id) REFERENCES sessions(id) ON DELETE CASCADE
+			);`,
+			"CREATE INDEX IF NOT EXISTS idx_session_access_tokens_session ON session_access_tokens(session_id);",
+		),
+		down: execStatements("DROP TABLE session_access_tokens;"),
+	},
+}
+
+type columnDef struct {
+	name       string
+	definition string
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrateDB applies every pending migration and refuses to run against a
+// database written by a newer binary.
+func migrateDB(db *sql.DB) error {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	if current > latestSchemaVersion() {
+		return fmt.Errorf("database schema version %d is newer than this binary (%d)", current, latestSchemaVersion())
+	}
+	for _, m := range migrations {
+		if m.version <= current {
+			continue
+		}
+		if err := applyMigration(db, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func applyMigration(db *sql.DB, m migration) error {
+	err := withTx(db, func(tx *sql.Tx) error {
+		if err := m.up(tx); err != nil {
+			return err
+		}
+		_, err := tx.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, ?, ?)", m.version, m.name, nowUnix())
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("migration %d (%s) failed: %w", m.version, m.name, err)
+	}
+	return nil
+}
+
+// rollbackMigration reverts the most recent migration if it has a down step.
+func rollbackMigration(db *sql.DB) (migration, error) {
+	current, err := schemaVersion(db)
+	if err != nil {
+		return migration{}, err
+	}
+	if current == 0 {
+		return migration{}, errors.New("no migration to roll back")
+	}
+	for _, m := range migrations {
+		if m.version != current {
+			continue
+		}
+		if m.down == nil {
+			return migration{}, fmt.Errorf("migration %d (%s) cannot be rolled back", m.version, m.name)
+		}
+		err := withTx(db, func(tx *sql.Tx) error {
+			if err := m.down(tx); err != nil {
+				return err
+			}
+			_, err := tx.Exec("DELETE FROM schema_migrations WHERE version = ?", m.version)
+			return err
+		})
+		if err != nil {
+			return migration{}, fmt.Errorf("rollback of %d (%s) failed: %w", m.version, m.name, err)
+		}
+		return m, nil
+	}
+	return migration{}, fmt.Errorf("database schema version %d is unknown to this binary", current)
+}
+
+func schemaVersion(db *sql.DB) (int, error) {
+	if _, err := db.Exec(
+		`CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			applied_at INTEGER NOT NULL
+		);`,
+	); err != nil {
+		return 0, fmt.Errorf("schema_migrations init failed: %w", err)
+	}
+	var version sql.NullInt64
+	if err := db.QueryRow("SELECT MAX(version) FROM schema_migrations").Scan(&version); err != nil {
+		return 0, err
+	}
+	return int(nullInt(version)), nil
+}
+
+func appliedMigrations(db *sql.DB) (map[int]migrationStatus, error) {
+	if _, err := schemaVersion(db); err != nil {
+		return nil, err
+	}
+	rows, err := db.Query("SELECT version, name, applied_at FROM schema_migrations ORDER BY version")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := make(map[int]migrationStatus)
+	for rows.Next() {
+		var status migrationStatus
+		if err := rows.Scan(&status.Version, &status.Name, &status.AppliedAt); err != nil {
+			return nil, err
+		}
+		applied[status.Version] = status
+	}
+	return applied, rows.Err()
+}
+
+// runMigrateCommand implements `migrate status|up|down` against DB_PATH.
+func runMigrateCommand(args []string, out io.Writer) error {
+	command := "status"
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	db, err := connectDB(envOr("DB_PATH", "./data/tictactoe.db"))
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	switch command {
+	case "status":
+		return printMigrationStatus(db, out)
+	case "up":
+		if err := migrateDB(db); err != nil {
+			return err
+		}
+		return printMigrationStatus(db, out)
+	case "down":
+		m, err := rollbackMigration(db)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(out, "rolled back %d %s\n", m.version, m.name)
+		return printMigrationStatus(db, out)
+	default:
+		return fmt.Errorf("unknown migrate command %q (want status, up or down)", command)
+	}
+}
+
+func printMigrationStatus(db *sql.DB, out io.Writer) error {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return err
+	}
+	current, err := schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "schema version %d (latest %d)\n", current, latestSchemaVersion())
+	known := make(map[int]bool)
+	for _, m := range migrations {
+		known[m.version] = true
+		state := "pending"
+		if status, ok := applied[m.version]; ok {
+			state = "applied " + time.Unix(status.AppliedAt, 0).UTC().Format(time.RFC3339)
+		}
+		fmt.Fprintf(out, "  %3d %-20s %s\n", m.version, m.name, state)
+	}
+	for version, status := range applied {
+		if !known[version] {
+			fmt.Fprintf(out, "  %3d %-20s applied by a newer binary\n", version, status.Name)
+		}
+	}
+	return nil
+}
+
+func execStatements(statements ...string) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		for _, stmt := range statements {
+			if _, err := tx.Exec(stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// addColumns is idempotent so databases that gained these columns before
+// versioning existed migrate cleanly.
+func addColumns(table string, columns ...columnDef) func(tx *sql.Tx) error {
+	return func(tx *sql.Tx) error {
+		existing, err := tableColumns(tx, table)
+		if err != nil {
+			return err
+		}
+		for _, col := range columns {
+			if existing[col.name] {
+				continue
+			}
+			if _, err := tx.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s;", table, col.name, col.definition)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+func tableColumns(tx *sql.Tx, table string) (map[string]bool, error) {
+	rows, err := tx.Query(fmt.Sprintf("PRAGMA table_info(%s);", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+	return columns, rows.Err()
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := connectDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("connect db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+func TestMigrationsOrdered(t *testing.T) {
+	names := make(map[string]bool)
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d (%s) has version %d, want %d", i, m.name, m.version, i+1)
+		}
+		if m.name == "" || names[m.name] {
+			t.Errorf("migration %d has an empty or duplicate name %q", m.version, m.name)
+		}
+		names[m.name] = true
+		if m.up == nil {
+			t.Errorf("migration %d (%s) has no up step", m.version, m.name)
+		}
+	}
+	if latestSchemaVersion() != len(migrations) {
+		t.Fatalf("latestSchemaVersion() = %d, want %d", latestSchemaVersion(), len(migrations))
+	}
+}
+
+func TestMigrateDB(t *testing.T) {
+	db := newTestDB(t)
+	for run := 0; run < 2; run++ {
+		if err := migrateDB(db); err != nil {
+			t.Fatalf("migrateDB run %d: %v", run+1, err)
+		}
+		version, err := schemaVersion(db)
+		if err != nil {
+			t.Fatalf("schemaVersion: %v", err)
+		}
+		if version != latestSchemaVersion() {
+			t.Fatalf("schema version after run %d = %d, want %d", run+1, version, latestSchemaVersion())
+		}
+	}
+
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		t.Fatalf("appliedMigrations: %v", err)
+	}
+	if len(applied) != len(migrations) {
+		t.Fatalf("%d migrations recorded, want %d", len(applied), len(migrations))
+	}
+	for _, m := range migrations {
+		if applied[m.version].Name != m.name {
+			t.Errorf("version %d recorded as %q, want %q", m.version, applied[m.version].Name, m.name)
+		}
+	}
+}
+
+func TestMigrateDBRefusesNewerSchema(t *testing.T) {
+	db := newTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatalf("migrateDB: %v", err)
+	}
+	if _, err := db.Exec("INSERT INTO schema_migrations (version, name, applied_at) VALUES (?, 'future', 1)", latestSchemaVersion()+1); err != nil {
+		t.Fatalf("insert future version: %v", err)
+	}
+	if err := migrateDB(db); err == nil {
+		t.Fatal("migrateDB accepted a schema from a newer binary")
+	}
+}
+
+func TestRollbackAndReapply(t *testing.T) {
+	db := newTestDB(t)
+	if err := migrateDB(db); err != nil {
+		t.Fatalf("migrateDB: %v", err)
+	}
+
+	for i := len(migrations) - 1; i >= 0 && migrations[i].down != nil; i-- {
+		m, err := rollbackMigration(db)
+		if err != nil {
+			t.Fatalf("rollback of %d (%s): %v", migrations[i].version, migrations[i].name, err)
+		}
+		if m.version != migrations[i].version {
+			t.Fatalf("rolled back %d, want %d", m.version, migrations[i].version)
+		}
+		version, err := schemaVersion(db)
+		if err != nil {
+			t.Fatalf("schemaVersion: %v", err)
+		}
+		if version != m.version-1 {
+			t.Fatalf("schema version after rolling back %d = %d, want %d", m.version, version, m.version-1)
+		}
+	}
+
+	if err := migrateDB(db); err != nil {
+		t.Fatalf("reapply: %v", err)
+	}
+	if version, err := schemaVersion(db); err != nil || version != latestSchemaVersion() {
+		t.Fatalf("schema version after reapply = %d, %v, want %d", version, err, latestSchemaVersion())
+	}
+}
@@ -0,0 +1,458 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Game notation: a block of `[Tag "value"]` header lines followed by one
+// numbered move per line (`3. X b2 @1520`, elapsed milliseconds after the
+// `@`). Cells are written column letter + row number from the top-left, and
+// ultimate moves as sub-board:cell (`b2:a1`). Games in a file are separated
+// by blank lines.
+
+const (
+	notationDateLayout = "2006-01-02"
+	notationResultDraw = "draw"
+	maxImportSize      = 1 << 20
+	importedRoomCode   = "IMPORT"
+)
+
+type importResponse struct {
+	Imported []int64 `json:"imported"`
+}
+
+func (s *Server) handleGameExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.userFromRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid game id", http.StatusBadRequest)
+		return
+	}
+
+	game, err := s.loadGame(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !game.viewableBy(user.ID)) {
+		http.Error(w, "game not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("game export failed: %v", err)
+		http.Error(w, "export failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeNotation(w, fmt.Sprintf("game-%d.ttn", game.ID), []gameDetail{game})
+}
+
+func (s *Server) handleHistoryExport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.userFromRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	ids, err := s.loadGameIDs(user.ID)
+	if err != nil {
+		log.Printf("history export failed: %v", err)
+		http.Error(w, "export failed", http.StatusInternalServerError)
+		return
+	}
+	games := make([]gameDetail, 0, len(ids))
+	for _, id := range ids {
+		game, err := s.loadGame(id)
+		if err != nil {
+			log.Printf("history export failed: %v", err)
+			http.Error(w, "export failed", http.StatusInternalServerError)
+			return
+		}
+		games = append(games, game)
+	}
+
+	writeNotation(w, "history.ttn", games)
+}
+
+func (s *Server) handleGameImport(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.userFromRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxImportSize))
+	if err != nil {
+		http.Error(w, "import too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	records, err := parseGames(string(body))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	response := importResponse{Imported: []int64{}}
+	err = withTx(s.db, func(tx *sql.Tx) error {
+		for _, record := range records {
+			record.ImportedBy = user.ID
+			id, err := storeGame(tx, record)
+			if err != nil {
+				return err
+			}
+			response.Imported = append(response.Imported, id)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("game import failed: %v", err)
+		http.Error(w, "import failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, response, http.StatusCreated)
+}
+
+func writeNotation(w http.ResponseWriter, filename string, games []gameDetail) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	w.WriteHeader(http.StatusOK)
+	for i, game := range games {
+		if i > 0 {
+			_, _ = io.WriteString(w, "\n")
+		}
+		_, _ = io.WriteString(w, formatGame(game))
+	}
+}
+
+func formatGame(game gameDetail) string {
+	var b strings.Builder
+	writeTag := func(name, value string) {
+		fmt.Fprintf(&b, "[%s %s]\n", name, strconv.Quote(value))
+	}
+
+	started := time.Unix(game.StartedAt, 0).UTC()
+	writeTag("Room", game.RoomCode)
+	writeTag("Date", started.Format(notationDateLayout))
+	writeTag("Started", started.Format(time.RFC3339))
+	writeTag("Ended", time.Unix(game.EndedAt, 0).UTC().Format(time.RFC3339))
+	writeTag("X", game.PlayerXName)
+	writeTag("O", game.PlayerOName)
+	writeTag("Variant", game.Variant)
+	writeTag("Board", fmt.Sprintf("%dx%d", game.Width, game.Height))
+	writeTag("WinLength", strconv.Itoa(game.WinLength))
+	writeTag("Misere", strconv.FormatBool(game.Misere))
+	if game.BotLevel != "" {
+		writeTag("Bot", game.BotLevel)
+	}
+	writeTag("Result", notationResult(game.WinnerSymbol, game.IsDraw))
+	b.WriteString("\n")
+
+	for _, move := range game.Moves {
+		fmt.Fprintf(&b, "%d. %s %s @%d\n", move.Ply, move.Symbol, formatMoveCell(game, move), move.ElapsedMs)
+	}
+	return b.String()
+}
+
+func notationResult(winner string, draw bool) string {
+	if draw || winner == "" {
+		return notationResultDraw
+	}
+	return winner
+}
+
+func formatMoveCell(game gameDetail, move moveRecord) string {
+	if game.Variant == variantUltimate {
+		return formatCoordinate(move.SubBoard, defaultBoardSize) + ":" + formatCoordinate(move.Cell, defaultBoardSize)
+	}
+	return formatCoordinate(move.Cell, game.Width)
+}
+
+func formatCoordinate(index, width int) string {
+	return fmt.Sprintf("%c%d", 'a'+rune(index%width), index/width+1)
+}
+
+func parseCoordinate(raw string, width, height int) (int, error) {
+	if len(raw) < 2 || raw[0] < 'a' || raw[0] > 'z' {
+		return 0, fmt.Errorf("invalid coordinate %q", raw)
+	}
+	col := int(raw[0] - 'a')
+	row, err := strconv.Atoi(raw[1:])
+	if err != nil || col >= width || row < 1 || row > height {
+		return 0, fmt.Errorf("invalid coordinate %q", raw)
+	}
+	return (row-1)*width + col, nil
+}
+
+// parseGames splits text into games and validates each one by replaying it
+// through the rules engine.
+func parseGames(text string) ([]gameRecord, error) {
+	blocks := splitGameBlocks(text)
+	if len(blocks) == 0 {
+		return nil, errors.New("no games found")
+	}
+
+	records := make([]gameRecord, 0, len(blocks))
+	for i, block := range blocks {
+		record, err := parseGame(block)
+		if err != nil {
+			return nil, fmt.Errorf("game %d: %w", i+1, err)
+		}
+		records = append(records, record)
+	}
+	return records, nil
+}
+
+// splitGameBlocks groups lines into games: a header line after move lines
+// starts a new game.
+func splitGameBlocks(text string) [][]string {
+	blocks := [][]string{}
+	var current []string
+	inMoves := false
+	scanner := bufio.NewScanner(strings.NewReader(text))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		isTag := strings.HasPrefix(line, "[")
+		if isTag && inMoves {
+			blocks = append(blocks, current)
+			current = nil
+			inMoves = false
+		}
+		if !isTag {
+			inMoves = true
+		}
+		current = append(current, line)
+	}
+	if len(current) > 0 {
+		blocks = append(blocks, current)
+	}
+	return blocks
+}
+
+func parseGame(lines []string) (gameRecord, error) {
+	tags := make(map[string]string)
+	var moveLines []string
+	for _, line := range lines {
+		if !strings.HasPrefix(line, "[") {
+			moveLines = append(moveLines, line)
+			continue
+		}
+		name, value, err := parseTag(line)
+		if err != nil {
+			return gameRecord{}, err
+		}
+		tags[name] = value
+	}
+
+	width, height := 0, 0
+	if board := tags["Board"]; board != "" {
+		if _, err := fmt.Sscanf(board, "%dx%d", &width, &height); err != nil {
+			return gameRecord{}, fmt.Errorf("invalid Board tag %q", board)
+		}
+	}
+	winLength := 0
+	if raw := tags["WinLength"]; raw != "" {
+		value, err := strconv.Atoi(raw)
+		if err != nil {
+			return gameRecord{}, fmt.Errorf("invalid WinLength tag %q", raw)
+		}
+		winLength = value
+	}
+	rules, err := newGameRules(tags["Variant"], width, height, winLength)
+	if err != nil {
+		return gameRecord{}, err
+	}
+	if raw := tags["Misere"]; raw != "" {
+		misere, err := strconv.ParseBool(raw)
+		if err != nil {
+			return gameRecord{}, fmt.Errorf("invalid Misere tag %q", raw)
+		}
+		rules.Misere = misere
+	}
+
+	record := gameRecord{
+		RoomCode:    strings.ToUpper(tags["Room"]),
+		Variant:     rules.Variant,
+		Width:       rules.Width,
+		Height:      rules.Height,
+		WinLength:   rules.WinLength,
+		Misere:      rules.Misere,
+		PlayerXName: sanitizeName(tags["X"], "Joueur X"),
+		PlayerOName: sanitizeName(tags["O"], "Joueur O"),
+	}
+	if record.RoomCode == "" {
+		record.RoomCode = importedRoomCode
+	}
+	if level := tags["Bot"]; level != "" {
+		if _, err := normalizeBotDifficulty(level); err != nil {
+			return gameRecord{}, err
+		}
+		record.BotLevel = level
+	}
+
+	for _, line := range moveLines {
+		move, err := parseMoveLine(line, rules)
+		if err != nil {
+			return gameRecord{}, err
+		}
+		record.Moves = append(record.Moves, move)
+	}
+
+	if err := applyNotationTimes(&record, tags); err != nil {
+		return gameRecord{}, err
+	}
+	if err := validateRecord(&record, rules, tags["Result"]); err != nil {
+		return gameRecord{}, err
+	}
+	return record, nil
+}
+
+func parseTag(line string) (string, string, error) {
+	if !strings.HasSuffix(line, "]") {
+		return "", "", fmt.Errorf("invalid tag line %q", line)
+	}
+	name, rawValue, ok := strings.Cut(strings.TrimSuffix(strings.TrimPrefix(line, "["), "]"), " ")
+	if !ok {
+		return "", "", fmt.Errorf("invalid tag line %q", line)
+	}
+	value, err := strconv.Unquote(strings.TrimSpace(rawValue))
+	if err != nil {
+		return "", "", fmt.Errorf("invalid tag value in %q", line)
+	}
+	return name, value, nil
+}
+
+func parseMoveLine(line string, rules gameRules) (moveRecord, error) {
+	fields := strings.Fields(line)
+	if len(fields) != 4 || !strings.HasSuffix(fields[0], ".") || !strings.HasPrefix(fields[3], "@") {
+		return moveRecord{}, fmt.Errorf("invalid move line %q", line)
+	}
+	ply, err := strconv.Atoi(strings.TrimSuffix(fields[0], "."))
+	if err != nil {
+		return moveRecord{}, fmt.Errorf("invalid move number in %q", line)
+	}
+	elapsed, err := strconv.ParseInt(strings.TrimPrefix(fields[3], "@"), 10, 64)
+	if err != nil || elapsed < 0 {
+		return moveRecord{}, fmt.Errorf("invalid move time in %q", line)
+	}
+
+	if fields[1] != symbolX && fields[1] != symbolO {
+		return moveRecord{}, fmt.Errorf("invalid symbol in %q", line)
+	}
+
+	move := moveRecord{Ply: ply, Symbol: fields[1], ElapsedMs: elapsed}
+	if rules.Variant == variantUltimate {
+		subRaw, cellRaw, ok := strings.Cut(fields[2], ":")
+		if !ok {
+			return moveRecord{}, fmt.Errorf("invalid ultimate move %q", fields[2])
+		}
+		if move.SubBoard, err = parseCoordinate(subRaw, defaultBoardSize, defaultBoardSize); err != nil {
+			return moveRecord{}, err
+		}
+		if move.Cell, err = parseCoordinate(cellRaw, defaultBoardSize, defaultBoardSize); err != nil {
+			return moveRecord{}, err
+		}
+		return move, nil
+	}
+	if move.Cell, err = parseCoordinate(fields[2], rules.Width, rules.Height); err != nil {
+		return moveRecord{}, err
+	}
+	return move, nil
+}
+
+func applyNotationTimes(record *gameRecord, tags map[string]string) error {
+	var started time.Time
+	var err error
+	switch {
+	case tags["Started"] != "":
+		started, err = time.Parse(time.RFC3339, tags["Started"])
+	case tags["Date"] != "":
+		started, err = time.Parse(notationDateLayout, tags["Date"])
+	default:
+		return errors.New("missing Started or Date tag")
+	}
+	if err != nil {
+		return fmt.Errorf("invalid start time: %w", err)
+	}
+	record.StartedAt = started.Unix()
+
+	if raw := tags["Ended"]; raw != "" {
+		ended, err := time.Parse(time.RFC3339, raw)
+		if err != nil {
+			return fmt.Errorf("invalid Ended tag: %w", err)
+		}
+		record.EndedAt = ended.Unix()
+	} else if len(record.Moves) > 0 {
+		record.EndedAt = started.Add(time.Duration(record.Moves[len(record.Moves)-1].ElapsedMs) * time.Millisecond).Unix()
+	} else {
+		record.EndedAt = record.StartedAt
+	}
+	if record.EndedAt < record.StartedAt {
+		return errors.New("game ends before it starts")
+	}
+	return nil
+}
+
+// validateRecord replays the moves with the live rules and checks that the
+// game is finished with the declared result.
+func validateRecord(record *gameRecord, rules gameRules, result string) error {
+	if len(record.Moves) == 0 {
+		return errors.New("game has no moves")
+	}
+
+	room := &Room{rules: rules, turn: record.Moves[0].Symbol}
+	room.resetBoardLocked()
+	var previous int64
+	for i, move := range record.Moves {
+		if move.Ply != i+1 {
+			return fmt.Errorf("move %d is numbered %d", i+1, move.Ply)
+		}
+		if move.ElapsedMs < previous {
+			return fmt.Errorf("move %d goes back in time", move.Ply)
+		}
+		previous = move.ElapsedMs
+		if err := room.replayMoveLocked(move); err != nil {
+			return fmt.Errorf("move %d: %w", move.Ply, err)
+		}
+	}
+
+	if room.winner == "" && !room.draw {
+		return errors.New("game is not finished")
+	}
+	computed := notationResult(room.winner, room.draw)
+	if result != "" && result != computed {
+		return fmt.Errorf("declared result %q does not match board (%s)", result, computed)
+	}
+	record.WinnerSymbol = room.winner
+	record.IsDraw = room.draw
+	return nil
+}
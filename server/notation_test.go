@@ -0,0 +1,177 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// notationMoves builds alternating moves starting with X, one second apart.
+func notationMoves(cells ...int) []moveRecord {
+	moves := make([]moveRecord, len(cells))
+	for i, cell := range cells {
+		symbol := symbolX
+		if i%2 == 1 {
+			symbol = symbolO
+		}
+		moves[i] = moveRecord{Ply: i + 1, Symbol: symbol, Cell: cell, ElapsedMs: int64(i+1) * 1000}
+	}
+	return moves
+}
+
+func TestNotationRoundTrip(t *testing.T) {
+	tests := []struct {
+		name       string
+		game       gameDetail
+		wantWinner string
+		wantDraw   bool
+	}{
+		{
+			name:       "classic win",
+			game:       gameDetail{Variant: variantClassic, Width: 3, Height: 3, WinLength: 3, WinnerSymbol: symbolX, Moves: notationMoves(0, 3, 1, 4, 2)},
+			wantWinner: symbolX,
+		},
+		{
+			name:       "misere loss",
+			game:       gameDetail{Variant: variantClassic, Width: 3, Height: 3, WinLength: 3, Misere: true, WinnerSymbol: symbolO, Moves: notationMoves(0, 3, 1, 4, 2)},
+			wantWinner: symbolO,
+		},
+		{
+			name:     "draw",
+			game:     gameDetail{Variant: variantClassic, Width: 3, Height: 3, WinLength: 3, IsDraw: true, Moves: notationMoves(0, 1, 2, 4, 3, 5, 7, 6, 8)},
+			wantDraw: true,
+		},
+		{
+			name:       "large board against a bot",
+			game:       gameDetail{Variant: variantClassic, Width: 5, Height: 4, WinLength: 4, BotLevel: botMedium, WinnerSymbol: symbolX, Moves: notationMoves(5, 0, 6, 1, 7, 2, 8)},
+			wantWinner: symbolX,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			game := tt.game
+			game.RoomCode = "ABCD"
+			game.PlayerXName = "Alice"
+			game.PlayerOName = "Bob"
+			game.StartedAt = 1700000000
+			game.EndedAt = 1700000060
+
+			records, err := parseGames(formatGame(game))
+			if err != nil {
+				t.Fatalf("parseGames: %v\n%s", err, formatGame(game))
+			}
+			if len(records) != 1 {
+				t.Fatalf("parsed %d games, want 1", len(records))
+			}
+			got := records[0]
+			want := gameRecord{
+				RoomCode:     game.RoomCode,
+				Variant:      game.Variant,
+				Width:        game.Width,
+				Height:       game.Height,
+				WinLength:    game.WinLength,
+				Misere:       game.Misere,
+				BotLevel:     game.BotLevel,
+				StartedAt:    game.StartedAt,
+				EndedAt:      game.EndedAt,
+				WinnerSymbol: tt.wantWinner,
+				IsDraw:       tt.wantDraw,
+				PlayerXName:  game.PlayerXName,
+				PlayerOName:  game.PlayerOName,
+				Moves:        game.Moves,
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Fatalf("round trip = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
+
+func TestParseGamesMultiple(t *testing.T) {
+	first := gameDetail{RoomCode: "AAAA", Variant: variantClassic, Width: 3, Height: 3, WinLength: 3, StartedAt: 1700000000, EndedAt: 1700000005, WinnerSymbol: symbolX, Moves: notationMoves(0, 3, 1, 4, 2)}
+	second := first
+	second.RoomCode = "BBBB"
+	second.Moves = notationMoves(0, 1, 2, 4, 3, 5, 7, 6, 8)
+	second.WinnerSymbol = ""
+	second.IsDraw = true
+
+	records, err := parseGames(formatGame(first) + "\n" + formatGame(second))
+	if err != nil {
+		t.Fatalf("parseGames: %v", err)
+	}
+	if len(records) != 2 || records[0].RoomCode != "AAAA" || records[1].RoomCode != "BBBB" || !records[1].IsDraw {
+		t.Fatalf("parseGames = %+v, want AAAA then a drawn BBBB", records)
+	}
+}
+
+func TestParseGamesRejects(t *testing.T) {
+	header := "[Date \"2024-01-02\"]\n[Board \"3x3\"]\n"
+	tests := []struct {
+		name string
+		text string
+	}{
+		{"empty", ""},
+		{"no moves", header},
+		{"missing date", "[Board \"3x3\"]\n\n1. X a1 @0\n"},
+		{"unfinished", header + "\n1. X a1 @0\n2. O a2 @10\n"},
+		{"wrong result", header + "[Result \"O\"]\n\n1. X a1 @0\n2. O a2 @1\n3. X b1 @2\n4. O b2 @3\n5. X c1 @4\n"},
+		{"out of turn", header + "\n1. X a1 @0\n2. X a2 @10\n"},
+		{"occupied cell", header + "\n1. X a1 @0\n2. O a1 @10\n"},
+		{"misnumbered", header + "\n1. X a1 @0\n3. O a2 @10\n"},
+		{"time goes back", header + "\n1. X a1 @50\n2. O a2 @10\n"},
+		{"off the board", header + "\n1. X d1 @0\n"},
+		{"bad tag", "[Board 3x3]\n\n1. X a1 @0\n"},
+		{"bad misere", header + "[Misere \"maybe\"]\n\n1. X a1 @0\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if records, err := parseGames(tt.text); err == nil {
+				t.Fatalf("parseGames(%q) = %+v, want an error", tt.text, records)
+			}
+		})
+	}
+}
+
+func TestCoordinates(t *testing.T) {
+	tests := []struct {
+		index, width, height int
+		want                 string
+	}{
+		{0, 3, 3, "a1"},
+		{4, 3, 3, "b2"},
+		{8, 3, 3, "c3"},
+		{14, 5, 4, "e3"},
+		{224, 15, 15, "o15"},
+	}
+	for _, tt := range tests {
+		got := formatCoordinate(tt.index, tt.width)
+		if got != tt.want {
+			t.Errorf("formatCoordinate(%d, %d) = %q, want %q", tt.index, tt.width, got, tt.want)
+		}
+		back, err := parseCoordinate(got, tt.width, tt.height)
+		if err != nil || back != tt.index {
+			t.Errorf("parseCoordinate(%q) = %d, %v, want %d", got, back, err, tt.index)
+		}
+	}
+	for _, raw := range []string{"", "a", "A1", "a0", "d1", "a4", "ax"} {
+		if _, err := parseCoordinate(raw, 3, 3); err == nil {
+			t.Errorf("parseCoordinate(%q) accepted", raw)
+		}
+	}
+}
+
+func TestFormatUltimateMove(t *testing.T) {
+	game := gameDetail{Variant: variantUltimate, Width: 3, Height: 3}
+	got := formatMoveCell(game, moveRecord{SubBoard: 4, Cell: 8})
+	if got != "b2:c3" {
+		t.Fatalf("formatMoveCell = %q, want b2:c3", got)
+	}
+	rules, _ := newGameRules(variantUltimate, 0, 0, 0)
+	move, err := parseMoveLine("1. X "+got+" @0", rules)
+	if err != nil || move.SubBoard != 4 || move.Cell != 8 {
+		t.Fatalf("parseMoveLine = %+v, %v, want sub-board 4 cell 8", move, err)
+	}
+	if _, err := parseMoveLine("1. X b2 @0", rules); err == nil || !strings.Contains(err.Error(), "ultimate") {
+		t.Fatalf("parseMoveLine without a sub-board = %v, want an ultimate move error", err)
+	}
+}
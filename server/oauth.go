@@ -0,0 +1,575 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	errIdentityTaken      = errors.New("account already linked to another user")
+	errProviderLinked     = errors.New("provider already linked")
+	errLastIdentity       = errors.New("cannot unlink the last login method")
+	errIdentityNotLinked  = errors.New("provider not linked")
+	errOAuthNotConfigured = errors.New("oauth not configured")
+	errUnknownProvider    = errors.New("unknown provider")
+)
+
+// oauthLinkStatePrefix marks the state of a login that links the account to
+// the signed-in user.
+const oauthLinkStatePrefix = "link."
+
+var oauthClient = &http.Client{Timeout: 10 * time.Second}
+
+// oauthProvider describes one authorization-code login. Every endpoint can be
+// overridden from the environment, which is how a fake server stands in for
+// the real provider.
+type oauthProvider struct {
+	Name         string
+	ClientID     string
+	ClientSecret string
+	RedirectURI  string
+	AuthURL      string
+	TokenURL     string
+	UserInfoURL  string
+	Scopes       []string
+	AuthParams   map[string]string
+	profile      func(data []byte) (oauthProfile, error)
+}
+
+// oauthProfile is the part of a provider account we keep. Subject is the
+// provider's stable account id.
+type oauthProfile struct {
+	Subject  string
+	Username string
+	Avatar   string
+}
+
+type oauthTokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	TokenType        string `json:"token_type"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+type identity struct {
+	Provider string `json:"provider"`
+	Username string `json:"username"`
+	Avatar   string `json:"avatar,omitempty"`
+}
+
+type providersResponse struct {
+	Providers []string `json:"providers"`
+}
+
+func (p *oauthProvider) configured() bool {
+	return p.ClientID != "" && p.ClientSecret != "" && p.RedirectURI != ""
+}
+
+func loadOAuthProviders() map[string]*oauthProvider {
+	providers := []*oauthProvider{
+		{
+			Name:        "discord",
+			AuthURL:     "https://discord.com/oauth2/authorize",
+			TokenURL:    "https://discord.com/api/v10/oauth2/token",
+			UserInfoURL: "https://discord.com/api/v10/users/@me",
+			Scopes:      []string{"identify"},
+			AuthParams:  map[string]string{"prompt": "consent"},
+			profile:     discordProfile,
+		},
+		{
+			Name:        "github",
+			AuthURL:     "https://github.com/login/oauth/authorize",
+			TokenURL:    "https://github.com/login/oauth/access_token",
+			UserInfoURL: "https://api.github.com/user",
+			Scopes:      []string{"read:user"},
+			profile:     githubProfile,
+		},
+		{
+			Name:        "google",
+			AuthURL:     "https://accounts.google.com/o/oauth2/v2/auth",
+			TokenURL:    "https://oauth2.googleapis.com/token",
+			UserInfoURL: "https://openidconnect.googleapis.com/v1/userinfo",
+			Scopes:      []string{"openid", "profile"},
+			AuthParams:  map[string]string{"prompt": "select_account"},
+			profile:     oidcProfile,
+		},
+	}
+
+	byName := make(map[string]*oauthProvider, len(providers))
+	for _, p := range providers {
+		prefix := strings.ToUpper(p.Name) + "_"
+		p.ClientID = strings.TrimSpace(os.Getenv(prefix + "CLIENT_ID"))
+		p.ClientSecret = strings.TrimSpace(os.Getenv(prefix + "CLIENT_SECRET"))
+		p.RedirectURI = strings.TrimSpace(os.Getenv(prefix + "REDIRECT_URL"))
+		p.AuthURL = envOr(prefix+"AUTH_URL", p.AuthURL)
+		p.TokenURL = envOr(prefix+"TOKEN_URL", p.TokenURL)
+		p.UserInfoURL = envOr(prefix+"USERINFO_URL", p.UserInfoURL)
+		byName[p.Name] = p
+	}
+	return byName
+}
+
+func (s *Server) oauthProvider(name string) (*oauthProvider, error) {
+	provider, ok := s.oauth[name]
+	if !ok {
+		return nil, errUnknownProvider
+	}
+	if !provider.configured() {
+		return nil, errOAuthNotConfigured
+	}
+	return provider, nil
+}
+
+func (s *Server) handleProviders(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	names := make([]string, 0, len(s.oauth))
+	for name, provider := range s.oauth {
+		if provider.configured() {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	writeJSON(w, providersResponse{Providers: names}, http.StatusOK)
+}
+
+// handleOAuthLogin starts a login with the provider in the path. With
+// link=1 the provider account is added to the signed-in user instead.
+func (s *Server) handleOAuthLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	provider, err := s.oauthProvider(r.PathValue("provider"))
+	if errors.Is(err, errUnknownProvider) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, r.PathValue("provider")+" oauth not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	// The link intent travels in the state, so it lasts exactly one attempt.
+	state := randomToken(18)
+	if r.URL.Query().Get("link") == "1" {
+		refreshToken, fromCookie := readRefreshToken(r)
+		if !fromCookie {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if _, _, err := s.sessionFromRefreshToken(refreshToken); err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		state = oauthLinkStatePrefix + state
+	}
+	setCookie(w, "oauth_state", state, 10*time.Minute, true, r)
+
+	guestToken := r.URL.Query().Get("guest_id")
+	if s.guestIDFromToken(guestToken) != "" {
+		setCookie(w, "guest_id", guestToken, 10*time.Minute, true, r)
+	}
+
+	returnTo := sanitizeReturnTo(r.URL.Query().Get("return_to"))
+	if returnTo != "" {
+		setCookie(w, "post_login_redirect", returnTo, 10*time.Minute, true, r)
+	}
+
+	http.Redirect(w, r, provider.authURL(state), http.StatusFound)
+}
+
+func (s *Server) handleOAuthCallback(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	provider, err := s.oauthProvider(r.PathValue("provider"))
+	if errors.Is(err, errUnknownProvider) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, r.PathValue("provider")+" oauth not configured", http.StatusServiceUnavailable)
+		return
+	}
+	state := r.URL.Query().Get("state")
+	code := r.URL.Query().Get("code")
+	if state == "" || code == "" {
+		http.Error(w, "invalid oauth response", http.StatusBadRequest)
+		return
+	}
+
+	if !matchesCookie(r, "oauth_state", state) {
+		http.Error(w, "invalid oauth state", http.StatusUnauthorized)
+		return
+	}
+
+	var linkUserID int64
+	if strings.HasPrefix(state, oauthLinkStatePrefix) {
+		refreshToken, _ := readRefreshToken(r)
+		_, user, err := s.sessionFromRefreshToken(refreshToken)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		linkUserID = user.ID
+	}
+
+	accessToken, err := provider.exchangeCode(code)
+	if err != nil {
+		log.Printf("%s token exchange failed: %v", provider.Name, err)
+		http.Error(w, "oauth exchange failed", http.StatusBadGateway)
+		return
+	}
+
+	profile, err := provider.fetchProfile(accessToken)
+	if err != nil {
+		log.Printf("%s user fetch failed: %v", provider.Name, err)
+		http.Error(w, "oauth user fetch failed", http.StatusBadGateway)
+		return
+	}
+
+	guestID := ""
+	if cookie, err := r.Cookie("guest_id"); err == nil {
+		guestID = s.guestIDFromToken(cookie.Value)
+	}
+
+	userID, err := s.upsertIdentity(provider.Name, profile, guestID, linkUserID)
+	if errors.Is(err, errIdentityTaken) || errors.Is(err, errProviderLinked) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("oauth user store failed: %v", err)
+		http.Error(w, "oauth user store failed", http.StatusInternalServerError)
+		return
+	}
+
+	if linkUserID == 0 {
+		_, refreshToken, _, refreshExp, err := s.createSession(userID)
+		if err != nil {
+			log.Printf("oauth session create failed: %v", err)
+			http.Error(w, "oauth session failed", http.StatusInternalServerError)
+			return
+		}
+		setRefreshCookie(w, refreshToken, refreshExp, r)
+	}
+	clearCookie(w, "oauth_state")
+	clearCookie(w, "guest_id")
+
+	redirectPath := "/"
+	if cookie, err := r.Cookie("post_login_redirect"); err == nil {
+		redirectPath = sanitizeReturnTo(cookie.Value)
+	}
+	clearCookie(w, "post_login_redirect")
+
+	http.Redirect(w, r, redirectPath, http.StatusFound)
+}
+
+// handleUnlinkIdentity removes a provider account from the caller, as long as
+// another one is left to sign in with.
+func (s *Server) handleUnlinkIdentity(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := s.userFromRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	err = s.unlinkIdentity(user.ID, r.PathValue("provider"))
+	if errors.Is(err, errIdentityNotLinked) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if errors.Is(err, errLastIdentity) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		log.Printf("identity unlink failed: %v", err)
+		http.Error(w, "unlink failed", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (p *oauthProvider) authURL(state string) string {
+	params := url.Values{}
+	params.Set("client_id", p.ClientID)
+	params.Set("redirect_uri", p.RedirectURI)
+	params.Set("response_type", "code")
+	params.Set("scope", strings.Join(p.Scopes, " "))
+	params.Set("state", state)
+	for key, value := range p.AuthParams {
+		params.Set(key, value)
+	}
+	separator := "?"
+	if strings.Contains(p.AuthURL, "?") {
+		separator = "&"
+	}
+	return p.AuthURL + separator + params.Encode()
+}
+
+func (p *oauthProvider) exchangeCode(code string) (string, error) {
+	data := url.Values{}
+	data.Set("client_id", p.ClientID)
+	data.Set("client_secret", p.ClientSecret)
+	data.Set("grant_type", "authorization_code")
+	data.Set("code", code)
+	data.Set("redirect_uri", p.RedirectURI)
+
+	req, err := http.NewRequest(http.MethodPost, p.TokenURL, strings.NewReader(data.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return "", fmt.Errorf("%s token error: %s", p.Name, string(body))
+	}
+	var token oauthTokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return "", err
+	}
+	// GitHub reports a bad code with a 200 and an error field.
+	if token.AccessToken == "" {
+		return "", fmt.Errorf("%s token error: %s %s", p.Name, token.Error, token.ErrorDescription)
+	}
+	return token.AccessToken, nil
+}
+
+func (p *oauthProvider) fetchProfile(accessToken string) (oauthProfile, error) {
+	req, err := http.NewRequest(http.MethodGet, p.UserInfoURL, nil)
+	if err != nil {
+		return oauthProfile{}, err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := oauthClient.Do(req)
+	if err != nil {
+		return oauthProfile{}, err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return oauthProfile{}, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return oauthProfile{}, fmt.Errorf("%s user error: %s", p.Name, string(body))
+	}
+	profile, err := p.profile(body)
+	if err != nil {
+		return oauthProfile{}, err
+	}
+	if profile.Subject == "" {
+		return oauthProfile{}, fmt.Errorf("%s user without id", p.Name)
+	}
+	if profile.Username == "" {
+		profile.Username = "Player"
+	}
+	return profile, nil
+}
+
+func discordProfile(data []byte) (oauthProfile, error) {
+	var user struct {
+		ID         string `json:"id"`
+		Username   string `json:"username"`
+		GlobalName string `json:"global_name"`
+		Avatar     string `json:"avatar"`
+	}
+	if err := json.Unmarshal(data, &user); err != nil {
+		return oauthProfile{}, err
+	}
+	profile := oauthProfile{Subject: user.ID, Username: strings.TrimSpace(user.GlobalName)}
+	if profile.Username == "" {
+		profile.Username = strings.TrimSpace(user.Username)
+	}
+	if user.Avatar != "" {
+		profile.Avatar = fmt.Sprintf("https://cdn.discordapp.com/avatars/%s/%s.png", user.ID, user.Avatar)
+	}
+	return profile, nil
+}
+
+func githubProfile(data []byte) (oauthProfile, error) {
+	var user struct {
+		ID        int64  `json:"id"`
+		Login     string `json:"login"`
+		Name      string `json:"name"`
+		AvatarURL string `json:"avatar_url"`
+	}
+	if err := json.Unmarshal(data, &user); err != nil {
+		return oauthProfile{}, err
+	}
+	profile := oauthProfile{Username: strings.TrimSpace(user.Name), Avatar: user.AvatarURL}
+	if user.ID != 0 {
+		profile.Subject = strconv.FormatInt(user.ID, 10)
+	}
+	if profile.Username == "" {
+		profile.Username = strings.TrimSpace(user.Login)
+	}
+	return profile, nil
+}
+
+// oidcProfile reads a standard OpenID Connect userinfo response.
+func oidcProfile(data []byte) (oauthProfile, error) {
+	var user struct {
+		Subject           string `json:"sub"`
+		Name              string `json:"name"`
+		PreferredUsername string `json:"preferred_username"`
+		Picture           string `json:"picture"`
+	}
+	if err := json.Unmarshal(data, &user); err != nil {
+		return oauthProfile{}, err
+	}
+	profile := oauthProfile{Subject: user.Subject, Username: strings.TrimSpace(user.Name), Avatar: user.Picture}
+	if profile.Username == "" {
+		profile.Username = strings.TrimSpace(user.PreferredUsername)
+	}
+	return profile, nil
+}
+
+// upsertIdentity signs in with, or links, a provider account. A known account
+// resolves to its user; a new one is attached to linkUserID when linking,
+// otherwise to the guest row (which becomes a registered user) or to a new
+// user. A guest row left behind is merged into the result.
+func (s *Server) upsertIdentity(provider string, profile oauthProfile, guestID string, linkUserID int64) (int64, error) {
+	now := nowUnix()
+	var userID int64
+	err := withTx(s.db, func(tx *sql.Tx) error {
+		var ownerID int64
+		ownerErr := tx.QueryRow("SELECT user_id FROM identities WHERE provider = ? AND subject = ?", provider, profile.Subject).Scan(&ownerID)
+		if ownerErr != nil && !errors.Is(ownerErr, sql.ErrNoRows) {
+			return ownerErr
+		}
+
+		guestID = normalizeGuestID(guestID)
+		var guestUserID int64
+		guestErr := sql.ErrNoRows
+		if guestID != "" {
+			guestErr = tx.QueryRow("SELECT id FROM users WHERE guest_id = ? AND is_guest = 1", guestID).Scan(&guestUserID)
+			if guestErr != nil && !errors.Is(guestErr, sql.ErrNoRows) {
+				return guestErr
+			}
+		}
+
+		switch {
+		case ownerErr == nil:
+			if linkUserID != 0 && linkUserID != ownerID {
+				return errIdentityTaken
+			}
+			userID = ownerID
+			if _, err := tx.Exec(
+				"UPDATE identities SET username = ?, avatar = ?, last_login_at = ? WHERE provider = ? AND subject = ?",
+				profile.Username, profile.Avatar, now, provider, profile.Subject,
+			); err != nil {
+				return err
+			}
+		case linkUserID != 0:
+			var existing string
+			err := tx.QueryRow("SELECT subject FROM identities WHERE user_id = ? AND provider = ?", linkUserID, provider).Scan(&existing)
+			if err == nil {
+				return errProviderLinked
+			}
+			if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+			userID = linkUserID
+		case guestErr == nil:
+			userID = guestUserID
+		default:
+			res, err := tx.Exec("INSERT INTO users (username, avatar, is_guest, created_at) VALUES (?, ?, 0, ?)", profile.Username, profile.Avatar, now)
+			if err != nil {
+				return err
+			}
+			if userID, err = res.LastInsertId(); err != nil {
+				return err
+			}
+		}
+
+		if ownerErr != nil {
+			if _, err := tx.Exec(
+				"INSERT INTO identities (provider, subject, user_id, username, avatar, created_at, last_login_at) VALUES (?, ?, ?, ?, ?, ?, ?)",
+				provider, profile.Subject, userID, profile.Username, profile.Avatar, now, now,
+			); err != nil {
+				return err
+			}
+		}
+		// Linking leaves the display name alone; signing in takes it from the
+		// account used.
+		if linkUserID == 0 {
+			if _, err := tx.Exec("UPDATE users SET username = ?, avatar = ?, is_guest = 0 WHERE id = ?", profile.Username, profile.Avatar, userID); err != nil {
+				return err
+			}
+		}
+		if guestErr == nil && guestUserID != userID {
+			return mergeUsers(tx, guestUserID, userID)
+		}
+		return nil
+	})
+	return userID, err
+}
+
+func (s *Server) unlinkIdentity(userID int64, provider string) error {
+	return withTx(s.db, func(tx *sql.Tx) error {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM identities WHERE user_id = ?", userID).Scan(&count); err != nil {
+			return err
+		}
+		res, err := tx.Exec("DELETE FROM identities WHERE user_id = ? AND provider = ?", userID, provider)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 0 {
+			return errIdentityNotLinked
+		}
+		if count <= 1 {
+			return errLastIdentity
+		}
+		return nil
+	})
+}
+
+func (s *Server) loadIdentities(userID int64) ([]identity, error) {
+	rows, err := s.db.Query("SELECT provider, username, COALESCE(avatar, '') FROM identities WHERE user_id = ? ORDER BY created_at, provider", userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var identities []identity
+	for rows.Next() {
+		var item identity
+		if err := rows.Scan(&item.Provider, &item.Username, &item.Avatar); err != nil {
+			return nil, err
+		}
+		identities = append(identities, item)
+	}
+	return identities, rows.Err()
+}
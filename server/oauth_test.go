@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestUpsertIdentityLinkKeepsGuestRatingAndTournament(t *testing.T) {
+	srv := newTestServer(t)
+	mustExec(t, srv, "INSERT INTO users (id, guest_id, username, is_guest, created_at) VALUES (1, 'guest-1', 'Guest', 1, 1)")
+	mustExec(t, srv, "INSERT INTO users (id, username, is_guest, created_at) VALUES (2, 'Account', 0, 1)")
+	mustExec(t, srv, "INSERT INTO ratings (user_id, rating, games, updated_at) VALUES (1, 1620, 12, 1)")
+	mustExec(t, srv, `INSERT INTO tournaments (id, name, format, status, variant, width, height, win_length, max_players, created_by, created_at)
+		VALUES (1, 'Cup', 'swiss', 'open', 'classic', 3, 3, 3, 8, 2, 1)`)
+	mustExec(t, srv, "INSERT INTO tournament_players (tournament_id, user_id, name, registered_at) VALUES (1, 1, 'Guest', 1)")
+
+	userID, err := srv.upsertIdentity("github", oauthProfile{Subject: "gh-1", Username: "octo"}, "guest-1", 2)
+	if err != nil {
+		t.Fatalf("upsertIdentity: %v", err)
+	}
+	if userID != 2 {
+		t.Fatalf("linked to user %d, want 2", userID)
+	}
+
+	var rating, games int
+	if err := srv.db.QueryRow("SELECT rating, games FROM ratings WHERE user_id = 2").Scan(&rating, &games); err != nil {
+		t.Fatalf("account rating: %v", err)
+	}
+	if rating != 1620 || games != 12 {
+		t.Fatalf("account rating = %d over %d games, want 1620 over 12", rating, games)
+	}
+	var entries int
+	if err := srv.db.QueryRow("SELECT COUNT(*) FROM tournament_players WHERE tournament_id = 1 AND user_id = 2").Scan(&entries); err != nil {
+		t.Fatalf("tournament entry: %v", err)
+	}
+	if entries != 1 {
+		t.Fatalf("account has %d entries in the tournament, want 1", entries)
+	}
+	var guests int
+	if err := srv.db.QueryRow("SELECT COUNT(*) FROM users WHERE id = 1").Scan(&guests); err != nil {
+		t.Fatalf("guest row: %v", err)
+	}
+	if guests != 0 {
+		t.Fatal("guest row still exists after the merge")
+	}
+}
+
+func TestUpsertIdentityMergeKeepsAccountRating(t *testing.T) {
+	srv := newTestServer(t)
+	mustExec(t, srv, "INSERT INTO users (id, guest_id, username, is_guest, created_at) VALUES (1, 'guest-1', 'Guest', 1, 1)")
+	mustExec(t, srv, "INSERT INTO users (id, username, is_guest, created_at) VALUES (2, 'Account', 0, 1)")
+	mustExec(t, srv, "INSERT INTO ratings (user_id, rating, games, updated_at) VALUES (1, 1300, 5, 1), (2, 1710, 40, 1)")
+
+	if _, err := srv.upsertIdentity("google", oauthProfile{Subject: "g-1", Username: "Account"}, "guest-1", 2); err != nil {
+		t.Fatalf("upsertIdentity: %v", err)
+	}
+	var rating int
+	if err := srv.db.QueryRow("SELECT rating FROM ratings WHERE user_id = 2").Scan(&rating); err != nil {
+		t.Fatalf("account rating: %v", err)
+	}
+	if rating != 1710 {
+		t.Fatalf("account rating = %d, want its own 1710", rating)
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"math"
+)
+
+const (
+	initialRating    = 1500
+	provisionalGames = 30
+	provisionalK     = 40.0
+	establishedK     = 20.0
+)
+
+type ratingChange struct {
+	Before int `json:"before"`
+	After  int `json:"after"`
+	Delta  int `json:"delta"`
+}
+
+type ratingInfo struct {
+	Rating int `json:"rating"`
+	Games  int `json:"games"`
+}
+
+type ratedPlayer struct {
+	userID  int64
+	guest   bool
+	rating  int
+	games   int
+	score   float64
+	updated int
+}
+
+// applyRatings updates Elo ratings for a game between two registered users and
+// keeps one rating_history row per player. It runs inside recordGame's
+// transaction after the game insert, which already holds SQLite's write lock,
+// so concurrent games cannot read a stale rating. Guests and bot games are
+// left alone and yield nil.
+func applyRatings(tx *sql.Tx, gameID int64, record gameRecord) (map[string]ratingChange, error) {
+	if record.BotLevel != "" || record.PlayerXID == 0 || record.PlayerOID == 0 || record.PlayerXID == record.PlayerOID {
+		return nil, nil
+	}
+
+	x, err := loadRatedPlayer(tx, record.PlayerXID)
+	if err != nil {
+		return nil, err
+	}
+	o, err := loadRatedPlayer(tx, record.PlayerOID)
+	if err != nil {
+		return nil, err
+	}
+	if x.guest || o.guest {
+		return nil, nil
+	}
+
+	switch {
+	case record.IsDraw:
+		x.score, o.score = 0.5, 0.5
+	case record.WinnerSymbol == symbolX:
+		x.score, o.score = 1, 0
+	default:
+		x.score, o.score = 0, 1
+	}
+	x.updated = nextRating(x, o)
+	o.updated = nextRating(o, x)
+
+	changes := make(map[string]ratingChange, 2)
+	for symbol, player := range map[string]ratedPlayer{symbolX: x, symbolO: o} {
+		if err := storeRating(tx, gameID, player, record.EndedAt); err != nil {
+			return nil, err
+		}
+		changes[symbol] = ratingChange{Before: player.rating, After: player.updated, Delta: player.updated - player.rating}
+	}
+	return changes, nil
+}
+
+func loadRatedPlayer(tx *sql.Tx, userID int64) (ratedPlayer, error) {
+	player := ratedPlayer{userID: userID}
+	var isGuest int
+	err := tx.QueryRow(
+		`SELECT u.is_guest, COALESCE(r.rating, ?), COALESCE(r.games, 0)
+		 FROM users u
+		 LEFT JOIN ratings r ON r.user_id = u.id
+		 WHERE u.id = ?`,
+		initialRating, userID,
+	).Scan(&isGuest, &player.rating, &player.games)
+	if err != nil {
+		return ratedPlayer{}, err
+	}
+	player.guest = isGuest == 1
+	return player, nil
+}
+
+func nextRating(player, opponent ratedPlayer) int {
+	k := establishedK
+	if player.games < provisionalGames {
+		k = provisionalK
+	}
+	expected := 1 / (1 + math.Pow(10, float64(opponent.rating-player.rating)/400))
+	return player.rating + int(math.Round(k*(player.score-expected)))
+}
+
+func storeRating(tx *sql.Tx, gameID int64, player ratedPlayer, at int64) error {
+	if _, err := tx.Exec(
+		`INSERT INTO ratings (user_id, rating, games, updated_at) VALUES (?, ?, 1, ?)
+		 ON CONFLICT(user_id) DO UPDATE SET rating = excluded.rating, games = ratings.games + 1, updated_at = excluded.updated_at`,
+		player.userID, player.updated, at,
+	); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		"INSERT INTO rating_history (game_id, user_id, rating_before, rating_after, created_at) VALUES (?, ?, ?, ?, ?)",
+		gameID, player.userID, player.rating, player.updated, at,
+	)
+	return err
+}
+
+// loadRating returns nil for users who have not played a rated game.
+func (s *Server) loadRating(userID int64) (*ratingInfo, error) {
+	var info ratingInfo
+	err := s.db.QueryRow("SELECT rating, games FROM ratings WHERE user_id = ?", userID).Scan(&info.Rating, &info.Games)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import "testing"
+
+func TestNextRating(t *testing.T) {
+	tests := []struct {
+		name     string
+		rating   int
+		games    int
+		score    float64
+		opponent int
+		want     int
+	}{
+		{"provisional win", 1500, 0, 1, 1500, 1520},
+		{"provisional loss", 1500, 0, 0, 1500, 1480},
+		{"even draw", 1500, 10, 0.5, 1500, 1500},
+		{"last provisional game", 1500, 29, 1, 1500, 1520},
+		{"established win", 1500, 30, 1, 1500, 1510},
+		{"favourite wins", 1600, 0, 1, 1400, 1610},
+		{"underdog wins", 1400, 0, 1, 1600, 1430},
+		{"favourite draws", 1600, 50, 0.5, 1400, 1595},
+		{"underdog draws", 1400, 50, 0.5, 1600, 1405},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			player := ratedPlayer{rating: tt.rating, games: tt.games, score: tt.score}
+			opponent := ratedPlayer{rating: tt.opponent}
+			if got := nextRating(player, opponent); got != tt.want {
+				t.Fatalf("nextRating() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRecordGameRatings(t *testing.T) {
+	tests := []struct {
+		name        string
+		botLevel    string
+		oGuest      bool
+		winner      string
+		draw        bool
+		wantChanges map[string]ratingChange
+	}{
+		{
+			name:   "x wins",
+			winner: symbolX,
+			wantChanges: map[string]ratingChange{
+				symbolX: {Before: 1500, After: 1520, Delta: 20},
+				symbolO: {Before: 1500, After: 1480, Delta: -20},
+			},
+		},
+		{
+			name: "draw",
+			draw: true,
+			wantChanges: map[string]ratingChange{
+				symbolX: {Before: 1500, After: 1500, Delta: 0},
+				symbolO: {Before: 1500, After: 1500, Delta: 0},
+			},
+		},
+		{name: "guest opponent", oGuest: true, winner: symbolX},
+		{name: "bot game", botLevel: botMedium, winner: symbolX},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newTestServer(t)
+			mustExec(t, srv, "INSERT INTO users (id, username, is_guest, created_at) VALUES (1, 'Alice', 0, 1), (2, 'Bob', ?, 1)", boolToInt(tt.oGuest))
+			record := gameRecord{
+				RoomCode: "ABCD", Variant: variantClassic, Width: 3, Height: 3, WinLength: 3,
+				BotLevel: tt.botLevel, StartedAt: 1, EndedAt: 2, WinnerSymbol: tt.winner, IsDraw: tt.draw,
+				PlayerXID: 1, PlayerOID: 2, PlayerXName: "Alice", PlayerOName: "Bob",
+			}
+
+			changes, err := srv.recordGame(record)
+			if err != nil {
+				t.Fatalf("recordGame: %v", err)
+			}
+			if len(changes) != len(tt.wantChanges) {
+				t.Fatalf("recordGame changes = %+v, want %+v", changes, tt.wantChanges)
+			}
+			for symbol, want := range tt.wantChanges {
+				if changes[symbol] != want {
+					t.Errorf("%s change = %+v, want %+v", symbol, changes[symbol], want)
+				}
+			}
+
+			var ratings, history int
+			if err := srv.db.QueryRow("SELECT COUNT(*) FROM ratings").Scan(&ratings); err != nil {
+				t.Fatalf("count ratings: %v", err)
+			}
+			if err := srv.db.QueryRow("SELECT COUNT(*) FROM rating_history").Scan(&history); err != nil {
+				t.Fatalf("count rating history: %v", err)
+			}
+			if ratings != len(tt.wantChanges) || history != len(tt.wantChanges) {
+				t.Fatalf("stored %d ratings and %d history rows, want %d of each", ratings, history, len(tt.wantChanges))
+			}
+		})
+	}
+}
+
+func TestRecordGameRatingsAccumulate(t *testing.T) {
+	srv := newTestServer(t)
+	mustExec(t, srv, "INSERT INTO users (id, username, is_guest, created_at) VALUES (1, 'Alice', 0, 1), (2, 'Bob', 0, 1)")
+	mustExec(t, srv, "INSERT INTO ratings (user_id, rating, games, updated_at) VALUES (1, 1600, 30, 1), (2, 1400, 3, 1)")
+	record := gameRecord{
+		RoomCode: "ABCD", Variant: variantClassic, Width: 3, Height: 3, WinLength: 3,
+		StartedAt: 1, EndedAt: 2, WinnerSymbol: symbolO,
+		PlayerXID: 1, PlayerOID: 2, PlayerXName: "Alice", PlayerOName: "Bob",
+	}
+	if _, err := srv.recordGame(record); err != nil {
+		t.Fatalf("recordGame: %v", err)
+	}
+
+	for _, tt := range []struct {
+		userID int64
+		rating int
+		games  int
+	}{
+		{1, 1585, 31},
+		{2, 1430, 4},
+	} {
+		info, err := srv.loadRating(tt.userID)
+		if err != nil {
+			t.Fatalf("loadRating(%d): %v", tt.userID, err)
+		}
+		if info == nil || info.Rating != tt.rating || info.Games != tt.games {
+			t.Errorf("loadRating(%d) = %+v, want %d over %d games", tt.userID, info, tt.rating, tt.games)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"time"
+)
+
+const (
+	reconnectTokenPurpose = "reconnect"
+	reconnectTokenTTL     = 24 * time.Hour
+)
+
+var (
+	errInvalidReconnectToken = errors.New("invalid reconnect token")
+	errReconnectTokenNeeded  = errors.New("reconnect token required")
+	errSeatNotYours          = errors.New("seat belongs to another player")
+)
+
+// reconnectClaims name one seat. User is the seat's owner when the token was
+// issued; the live seat's owner is checked again on reclaim.
+type reconnectClaims struct {
+	Room    string `json:"r"`
+	Player  string `json:"p"`
+	User    int64  `json:"u,omitempty"`
+	Expires int64  `json:"e"`
+}
+
+// reconnectToken signs a token for a seated player; spectators and bots get
+// none.
+func (s *Server) reconnectToken(room *Room, player *Player) string {
+	room.mu.Lock()
+	if player.spectator || player.bot {
+		room.mu.Unlock()
+		return ""
+	}
+	claims := reconnectClaims{
+		Room:    room.code,
+		Player:  player.id,
+		User:    player.userID,
+		Expires: time.Now().Add(reconnectTokenTTL).Unix(),
+	}
+	room.mu.Unlock()
+
+	token, err := signToken(s.signingKey, reconnectTokenPurpose, claims)
+	if err != nil {
+		return ""
+	}
+	return token
+}
+
+// reclaimSeatLocked finds the seat a returning player asks for, by reconnect
+// token or by player id. A seat with an owner only goes back to the same user;
+// an anonymous seat needs the token. It returns nil when no seat matches so
+// the caller can fall back to a normal join.
+func (r *Room) reclaimSeatLocked(key []byte, token, playerID string, userID int64) (*Player, error) {
+	viaToken := token != ""
+	if viaToken {
+		var claims reconnectClaims
+		if err := verifyToken(key, reconnectTokenPurpose, token, &claims); err != nil {
+			return nil, errInvalidReconnectToken
+		}
+		if !strings.EqualFold(claims.Room, r.code) || claims.Expires < time.Now().Unix() {
+			return nil, errInvalidReconnectToken
+		}
+		playerID = claims.Player
+	}
+
+	var seat *Player
+	for _, candidate := range []*Player{r.playerX, r.playerO} {
+		if candidate != nil && !candidate.bot && candidate.id == playerID {
+			seat = candidate
+		}
+	}
+	if seat == nil {
+		return nil, nil
+	}
+	if seat.connected {
+		return nil, errors.New("player already connected")
+	}
+	if seat.userID != 0 && seat.userID != userID {
+		return nil, errSeatNotYours
+	}
+	if seat.userID == 0 && !viaToken {
+		return nil, errReconnectTokenNeeded
+	}
+	return seat, nil
+}
+
+// seatForUserLocked returns the disconnected seat held by userID, which lets
+// a signed-in player resume from another device with just the room code. It
+// also hands out the reserved seats of tournament rooms.
+func (r *Room) seatForUserLocked(userID int64) *Player {
+	if userID == 0 {
+		return nil
+	}
+	for _, seat := range []*Player{r.playerX, r.playerO} {
+		if seat != nil && !seat.bot && seat.userID == userID && !seat.connected {
+			return seat
+		}
+	}
+	return nil
+}
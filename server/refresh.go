@@ -0,0 +1,223 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+)
+
+var (
+	errInvalidRefresh = errors.New("invalid refresh token")
+	errRefreshReused  = errors.New("refresh token reused")
+)
+
+// sessionTokens is one issued access/refresh pair.
+type sessionTokens struct {
+	AccessToken  string `json:"a"`
+	RefreshToken string `json:"r"`
+	AccessExp    int64  `json:"ae"`
+	RefreshExp   int64  `json:"re"`
+}
+
+// refreshSession rotates a session's refresh token. Every rotated token is
+// kept in rotated_refresh_tokens for the session's family. Presenting one of
+// them again within the grace window answers with the refresh token it was
+// rotated into, so tabs refreshing at the same time end up sharing it, and a
+// fresh access token of its own; after that it counts as reuse and the whole
+// session is revoked.
+func (s *Server) refreshSession(refreshToken string) (User, sessionTokens, error) {
+	if refreshToken == "" {
+		return User{}, sessionTokens{}, errInvalidRefresh
+	}
+	oldHash := hashToken(refreshToken)
+	now := nowUnix()
+	next := sessionTokens{
+		AccessToken:  randomToken(24),
+		RefreshToken: randomToken(36),
+		AccessExp:    now + int64(accessTokenTTL.Seconds()),
+		RefreshExp:   now + int64(refreshTokenTTL.Seconds()),
+	}
+
+	var user User
+	var issued sessionTokens
+	var revoked int64
+	err := withTx(s.db, func(tx *sql.Tx) error {
+		// Writing first takes the database lock, so concurrent refreshes of
+		// the same token queue up here instead of both rotating it.
+		res, err := tx.Exec(
+			"UPDATE sessions SET access_token_hash = ?, access_expires_at = ?, refresh_token_hash = ?, refresh_expires_at = ? WHERE refresh_token_hash = ? AND refresh_expires_at > ?",
+			hashToken(next.AccessToken), next.AccessExp, hashToken(next.RefreshToken), next.RefreshExp, oldHash, now,
+		)
+		if err != nil {
+			return err
+		}
+		affected, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if affected == 1 {
+			sessionID, err := sessionIDByRefreshHash(tx, hashToken(next.RefreshToken))
+			if err != nil {
+				return err
+			}
+			successor, err := sealSuccessor(refreshToken, sessionTokens{RefreshToken: next.RefreshToken, RefreshExp: next.RefreshExp})
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(
+				"UPDATE rotated_refresh_tokens SET successor = NULL WHERE session_id = ? AND rotated_at < ?",
+				sessionID, now-int64(s.refreshGrace.Seconds()),
+			); err != nil {
+				return err
+			}
+			if _, err := tx.Exec(
+				"INSERT INTO rotated_refresh_tokens (token_hash, session_id, rotated_at, successor) VALUES (?, ?, ?, ?)",
+				oldHash, sessionID, now, successor,
+			); err != nil {
+				return err
+			}
+			issued = next
+			user, err = sessionUser(tx, sessionID)
+			return err
+		}
+
+		var sessionID, rotatedAt int64
+		var successor sql.NullString
+		err = tx.QueryRow(
+			"SELECT session_id, rotated_at, successor FROM rotated_refresh_tokens WHERE token_hash = ?",
+			oldHash,
+		).Scan(&sessionID, &rotatedAt, &successor)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errInvalidRefresh
+		}
+		if err != nil {
+			return err
+		}
+
+		// A session that is already gone (logged out or revoked) has nothing
+		// left to protect.
+		user, err = sessionUser(tx, sessionID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return errInvalidRefresh
+		}
+		if err != nil {
+			return err
+		}
+
+		if successor.Valid && now-rotatedAt <= int64(s.refreshGrace.Seconds()) {
+			// The access token minted with the successor may be rotated away
+			// already, so this caller gets one of its own.
+			shared, err := openSuccessor(refreshToken, successor.String)
+			if err != nil {
+				return err
+			}
+			if _, err := tx.Exec(
+				"INSERT INTO session_access_tokens (token_hash, session_id, expires_at) VALUES (?, ?, ?)",
+				hashToken(next.AccessToken), sessionID, next.AccessExp,
+			); err != nil {
+				return err
+			}
+			issued = sessionTokens{
+				AccessToken:  next.AccessToken,
+				AccessExp:    next.AccessExp,
+				RefreshToken: shared.RefreshToken,
+				RefreshExp:   shared.RefreshExp,
+			}
+			return nil
+		}
+
+		if _, err := tx.Exec("DELETE FROM rotated_refresh_tokens WHERE session_id = ?", sessionID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM session_access_tokens WHERE session_id = ?", sessionID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("DELETE FROM sessions WHERE id = ?", sessionID); err != nil {
+			return err
+		}
+		revoked = sessionID
+		return nil
+	})
+	if err != nil {
+		return User{}, sessionTokens{}, err
+	}
+	if revoked != 0 {
+		s.refreshReuse.Add(1)
+		log.Printf("security: rotated refresh token reused on session %d of user %d, session revoked", revoked, user.ID)
+		return User{}, sessionTokens{}, errRefreshReused
+	}
+	return user, issued, nil
+}
+
+func sessionIDByRefreshHash(tx *sql.Tx, hash string) (int64, error) {
+	var sessionID int64
+	err := tx.QueryRow("SELECT id FROM sessions WHERE refresh_token_hash = ?", hash).Scan(&sessionID)
+	return sessionID, err
+}
+
+func sessionUser(tx *sql.Tx, sessionID int64) (User, error) {
+	var user User
+	var isGuest int
+	err := tx.QueryRow(
+		`SELECT u.id, COALESCE((SELECT i.subject FROM identities i WHERE i.user_id = u.id AND i.provider = 'discord'), ''), u.username, COALESCE(u.avatar, ''), u.is_guest
+		 FROM sessions s
+		 JOIN users u ON u.id = s.user_id
+		 WHERE s.id = ?`,
+		sessionID,
+	).Scan(&user.ID, &user.DiscordID, &user.Username, &user.Avatar, &isGuest)
+	user.IsGuest = isGuest == 1
+	return user, err
+}
+
+// sealSuccessor encrypts the refresh token a refresh token was rotated into
+// under a key derived from that token, so only its holder can read it back.
+func sealSuccessor(refreshToken string, tokens sessionTokens) (string, error) {
+	aead, err := successorCipher(refreshToken)
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(tokens)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(aead.Seal(nonce, nonce, data, nil)), nil
+}
+
+func openSuccessor(refreshToken, sealed string) (sessionTokens, error) {
+	aead, err := successorCipher(refreshToken)
+	if err != nil {
+		return sessionTokens{}, err
+	}
+	data, err := base64.RawURLEncoding.DecodeString(sealed)
+	if err != nil || len(data) < aead.NonceSize() {
+		return sessionTokens{}, errInvalidRefresh
+	}
+	plain, err := aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], nil)
+	if err != nil {
+		return sessionTokens{}, errInvalidRefresh
+	}
+	var tokens sessionTokens
+	if err := json.Unmarshal(plain, &tokens); err != nil {
+		return sessionTokens{}, errInvalidRefresh
+	}
+	return tokens, nil
+}
+
+func successorCipher(refreshToken string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("refresh-successor\x00" + refreshToken))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
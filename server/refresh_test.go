@@ -0,0 +1,148 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// newRefreshServer returns a server with one signed-in user and the tokens of
+// its session.
+func newRefreshServer(t *testing.T) (*Server, string, string) {
+	t.Helper()
+	srv := newTestServer(t)
+	srv.refreshGrace = 30 * time.Second
+	mustExec(t, srv, "INSERT INTO users (id, username, is_guest, created_at) VALUES (1, 'Alice', 0, 1)")
+	access, refresh, _, _, err := srv.createSession(1)
+	if err != nil {
+		t.Fatalf("createSession: %v", err)
+	}
+	return srv, access, refresh
+}
+
+func sessionCount(t *testing.T, srv *Server) int {
+	t.Helper()
+	var count int
+	if err := srv.db.QueryRow("SELECT COUNT(*) FROM sessions").Scan(&count); err != nil {
+		t.Fatalf("count sessions: %v", err)
+	}
+	return count
+}
+
+func TestRefreshSessionRotates(t *testing.T) {
+	srv, access, refresh := newRefreshServer(t)
+
+	user, tokens, err := srv.refreshSession(refresh)
+	if err != nil {
+		t.Fatalf("refreshSession: %v", err)
+	}
+	if user.ID != 1 {
+		t.Fatalf("refreshed user %d, want 1", user.ID)
+	}
+	if tokens.RefreshToken == refresh || tokens.AccessToken == access {
+		t.Fatal("refresh did not rotate the tokens")
+	}
+	if _, err := srv.userFromAccessToken(access); err == nil {
+		t.Fatal("old access token still valid after rotation")
+	}
+	if _, err := srv.userFromAccessToken(tokens.AccessToken); err != nil {
+		t.Fatalf("new access token: %v", err)
+	}
+	if _, _, err := srv.refreshSession(tokens.RefreshToken); err != nil {
+		t.Fatalf("refresh with the rotated token: %v", err)
+	}
+}
+
+func TestRefreshSessionInvalid(t *testing.T) {
+	for _, token := range []string{"", "not-a-token"} {
+		srv, _, _ := newRefreshServer(t)
+		if _, _, err := srv.refreshSession(token); !errors.Is(err, errInvalidRefresh) {
+			t.Errorf("refreshSession(%q) error = %v, want %v", token, err, errInvalidRefresh)
+		}
+	}
+}
+
+func TestRefreshSessionGraceWindow(t *testing.T) {
+	srv, _, refresh := newRefreshServer(t)
+
+	_, first, err := srv.refreshSession(refresh)
+	if err != nil {
+		t.Fatalf("first refresh: %v", err)
+	}
+	_, second, err := srv.refreshSession(refresh)
+	if err != nil {
+		t.Fatalf("refresh within the grace window: %v", err)
+	}
+	if second.RefreshToken != first.RefreshToken || second.RefreshExp != first.RefreshExp {
+		t.Fatal("concurrent refreshes did not share the rotated refresh token")
+	}
+	if second.AccessToken == first.AccessToken {
+		t.Fatal("grace refresh replayed the stored access token")
+	}
+	for _, access := range []string{first.AccessToken, second.AccessToken} {
+		if _, err := srv.userFromAccessToken(access); err != nil {
+			t.Fatalf("access token after grace refresh: %v", err)
+		}
+	}
+
+	// Rotating the shared token again must not strand the grace caller's
+	// access token, and logging out with it ends the whole session.
+	if _, _, err := srv.refreshSession(first.RefreshToken); err != nil {
+		t.Fatalf("refresh of the shared token: %v", err)
+	}
+	if _, err := srv.userFromAccessToken(second.AccessToken); err != nil {
+		t.Fatalf("grace access token after the next rotation: %v", err)
+	}
+	if err := srv.deleteSessionByAccessToken(second.AccessToken); err != nil {
+		t.Fatalf("deleteSessionByAccessToken: %v", err)
+	}
+	if n := sessionCount(t, srv); n != 0 {
+		t.Fatalf("%d sessions left after logout, want 0", n)
+	}
+}
+
+func TestRefreshSessionReuseAfterGrace(t *testing.T) {
+	srv, _, refresh := newRefreshServer(t)
+
+	_, tokens, err := srv.refreshSession(refresh)
+	if err != nil {
+		t.Fatalf("refreshSession: %v", err)
+	}
+	mustExec(t, srv, "UPDATE rotated_refresh_tokens SET rotated_at = rotated_at - 60")
+
+	if _, _, err := srv.refreshSession(refresh); !errors.Is(err, errRefreshReused) {
+		t.Fatalf("reuse after the grace window error = %v, want %v", err, errRefreshReused)
+	}
+	if n := sessionCount(t, srv); n != 0 {
+		t.Fatalf("%d sessions left after reuse, want 0", n)
+	}
+	if got := srv.refreshReuse.Load(); got != 1 {
+		t.Fatalf("reuse counter = %d, want 1", got)
+	}
+	if _, err := srv.userFromAccessToken(tokens.AccessToken); err == nil {
+		t.Fatal("access token still valid after the session was revoked")
+	}
+	if _, _, err := srv.refreshSession(tokens.RefreshToken); !errors.Is(err, errInvalidRefresh) {
+		t.Fatalf("refresh on the revoked session error = %v, want %v", err, errInvalidRefresh)
+	}
+}
+
+func TestRefreshSessionAfterLogout(t *testing.T) {
+	srv, _, refresh := newRefreshServer(t)
+
+	_, tokens, err := srv.refreshSession(refresh)
+	if err != nil {
+		t.Fatalf("refreshSession: %v", err)
+	}
+	if err := srv.deleteSessionByRefreshToken(tokens.RefreshToken); err != nil {
+		t.Fatalf("deleteSessionByRefreshToken: %v", err)
+	}
+	mustExec(t, srv, "UPDATE rotated_refresh_tokens SET rotated_at = rotated_at - 60")
+
+	if _, _, err := srv.refreshSession(refresh); !errors.Is(err, errInvalidRefresh) {
+		t.Fatalf("old token after logout error = %v, want %v", err, errInvalidRefresh)
+	}
+	if got := srv.refreshReuse.Load(); got != 0 {
+		t.Fatalf("reuse counter = %d after logout, want 0", got)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultReplaySpeed = 1.0
+	maxReplaySpeed     = 32.0
+	maxReplayDelay     = 10 * time.Second
+)
+
+type watchReplayPayload struct {
+	GameID int64   `json:"game_id"`
+	Speed  float64 `json:"speed,omitempty"`
+}
+
+type replayFinishedPayload struct {
+	GameID int64 `json:"game_id"`
+}
+
+type replayStream struct {
+	stop chan struct{}
+	once sync.Once
+}
+
+func (s *Server) handleGame(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	user, err := s.userFromRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid game id", http.StatusBadRequest)
+		return
+	}
+
+	// Games of other players answer like missing ones so ids cannot be probed.
+	game, err := s.loadGame(id)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !game.viewableBy(user.ID)) {
+		http.Error(w, "game not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("game load failed: %v", err)
+		http.Error(w, "game failed", http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, game, http.StatusOK)
+}
+
+// watchReplay streams one of the signed-in user's finished games to the
+// session's own writer. Replay frames are plain state messages, so a seated
+// player has to leave first and a spectator leaves the room it was watching.
+func (s *Server) watchReplay(session *Session, payload watchReplayPayload) error {
+	room, player := session.get()
+	live := false
+	if room != nil && player != nil {
+		room.mu.Lock()
+		live = !room.closed && player.connected
+		room.mu.Unlock()
+		if live && !player.spectator {
+			return errors.New("leave your seat before watching a replay")
+		}
+	}
+
+	var userID int64
+	if id := session.getUserID(); id != nil {
+		userID = *id
+	}
+	game, err := s.loadGame(payload.GameID)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !game.viewableBy(userID)) {
+		return errors.New("game not found")
+	}
+	if err != nil {
+		log.Printf("replay load failed: %v", err)
+		return errors.New("replay failed")
+	}
+
+	if live {
+		s.leaveAsSpectator(room, player)
+	}
+	session.set(nil, nil)
+
+	speed := payload.Speed
+	if speed <= 0 {
+		speed = defaultReplaySpeed
+	}
+	speed = min(speed, maxReplaySpeed)
+
+	stream := session.startReplay()
+	go streamReplay(session.writer, stream, game, speed)
+	return nil
+}
+
+// streamReplay replays the stored moves through a detached room so every
+// frame uses the same statePayload shape as a live game.
+func streamReplay(viewer *Player, stream *replayStream, game gameDetail, speed float64) {
+	room := replayRoom(game)
+	if !stream.send(viewer, room.replayStateLocked()) {
+		return
+	}
+
+	var previous int64
+	for _, move := range game.Moves {
+		delay := time.Duration(float64(time.Duration(move.ElapsedMs-previous)*time.Millisecond) / speed)
+		previous = move.ElapsedMs
+		select {
+		case <-time.After(min(max(delay, 0), maxReplayDelay)):
+		case <-stream.stop:
+			return
+		}
+
+		if err := room.replayMoveLocked(move); err != nil {
+			log.Printf("replay of game %d diverged at ply %d: %v", game.ID, move.Ply, err)
+			return
+		}
+		if !stream.send(viewer, room.replayStateLocked()) {
+			return
+		}
+	}
+
+	_ = viewer.send(newMessage("replay_finished", replayFinishedPayload{GameID: game.ID}))
+}
+
+func replayRoom(game gameDetail) *Room {
+	room := &Room{
+		code: game.RoomCode,
+		rules: gameRules{
+			Variant:   game.Variant,
+			Width:     game.Width,
+			Height:    game.Height,
+			WinLength: game.WinLength,
+			Misere:    game.Misere,
+		},
+		turn:    symbolX,
+		playerX: &Player{name: game.PlayerXName, symbol: symbolX},
+		playerO: &Player{name: game.PlayerOName, symbol: symbolO},
+	}
+	if len(game.Moves) > 0 {
+		room.turn = game.Moves[0].Symbol
+	}
+	room.startingSymbol = room.turn
+	room.resetBoardLocked()
+	return room
+}
+
+func (r *Room) replayMoveLocked(move moveRecord) error {
+	if r.winner != "" || r.draw {
+		return errors.New("game already finished")
+	}
+	if move.Symbol != r.turn {
+		return errors.New("not your turn")
+	}
+	payload := movePayload{SubBoard: move.SubBoard, Cell: move.Cell}
+	if !r.moveInRange(payload) {
+		return errors.New("invalid cell")
+	}
+	if err := r.placeLocked(move.Symbol, payload); err != nil {
+		return err
+	}
+
+	if winner := r.checkWinner(); winner != "" {
+		r.winner = winner
+	} else if r.checkDraw() {
+		r.draw = true
+	} else {
+		r.turn = otherSymbol(move.Symbol)
+	}
+	return nil
+}
+
+func (r *Room) replayStateLocked() statePayload {
+	state := r.snapshotLocked()
+	if state.Status != statusWin && state.Status != statusDraw {
+		state.Status = statusInProgress
+	}
+	return state
+}
+
+func (r *replayStream) send(viewer *Player, state statePayload) bool {
+	select {
+	case <-r.stop:
+		return false
+	default:
+	}
+	return viewer.send(newMessage("state", state)) == nil
+}
+
+func (r *replayStream) cancel() {
+	r.once.Do(func() {
+		close(r.stop)
+	})
+}
+
+func (s *Session) startReplay() *replayStream {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replay != nil {
+		s.replay.cancel()
+	}
+	s.replay = &replayStream{stop: make(chan struct{})}
+	return s.replay
+}
+
+func (s *Session) stopReplay() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.replay != nil {
+		s.replay.cancel()
+		s.replay = nil
+	}
+}
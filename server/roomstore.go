@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"time"
+)
+
+type persistedPlayer struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Symbol string `json:"symbol,omitempty"`
+	UserID int64  `json:"user_id,omitempty"`
+	Bot    bool   `json:"bot,omitempty"`
+}
+
+type persistedRoom struct {
+	Code              string           `json:"code"`
+	Rules             gameRules        `json:"rules"`
+	Board             []string         `json:"board"`
+	SubWinners        []string         `json:"sub_winners,omitempty"`
+	ForcedBoard       int              `json:"forced_board"`
+	Turn              string           `json:"turn"`
+	StartingSymbol    string           `json:"starting_symbol"`
+	Winner            string           `json:"winner,omitempty"`
+	Draw              bool             `json:"draw,omitempty"`
+	StartedAt         time.Time        `json:"started_at"`
+	Moves             []moveRecord     `json:"moves,omitempty"`
+	Recorded          bool             `json:"recorded,omitempty"`
+	BotDifficulty     string           `json:"bot_difficulty,omitempty"`
+	Private           bool             `json:"private,omitempty"`
+	PasswordHash      string           `json:"password_hash,omitempty"`
+	AllowedUserIDs    []int64          `json:"allowed_user_ids,omitempty"`
+	TournamentMatchID int64            `json:"tournament_match_id,omitempty"`
+	PlayerX           *persistedPlayer `json:"player_x,omitempty"`
+	PlayerO           *persistedPlayer `json:"player_o,omitempty"`
+}
+
+// saveRoom writes the room to live_rooms so it can be rehydrated after a
+// restart. Snapshots carry a version taken under the room lock, so a slow
+// writer never overwrites a newer state.
+func (s *Server) saveRoom(room *Room) {
+	room.mu.Lock()
+	if room.closed {
+		room.mu.Unlock()
+		return
+	}
+	room.version++
+	version := room.version
+	state := room.persistedLocked()
+	room.mu.Unlock()
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		log.Printf("room %s persist failed: %v", room.code, err)
+		return
+	}
+	_, err = s.db.Exec(
+		`INSERT INTO live_rooms (code, version, state, updated_at) VALUES (?, ?, ?, ?)
+		 ON CONFLICT(code) DO UPDATE SET version = excluded.version, state = excluded.state, updated_at = excluded.updated_at
+		 WHERE excluded.version > live_rooms.version`,
+		room.code, version, string(data), nowUnix(),
+	)
+	if err != nil {
+		log.Printf("room %s persist failed: %v", room.code, err)
+	}
+	s.notifyLobby()
+}
+
+func (s *Server) deleteRoomState(code string) {
+	if _, err := s.db.Exec("DELETE FROM live_rooms WHERE code = ?", code); err != nil {
+		log.Printf("room %s delete failed: %v", code, err)
+	}
+}
+
+// restoreRooms loads the rooms that were live when the server stopped. Every
+// human seat starts disconnected with the usual reconnect grace period, except
+// in tournament rooms still waiting for their game; those whose match was
+// settled meanwhile are closed. Spectators are not persisted and join again.
+func (s *Server) restoreRooms() (int, error) {
+	rows, err := s.db.Query("SELECT version, state FROM live_rooms")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	rooms := []*Room{}
+	for rows.Next() {
+		var version int64
+		var data string
+		if err := rows.Scan(&version, &data); err != nil {
+			return 0, err
+		}
+		var state persistedRoom
+		if err := json.Unmarshal([]byte(data), &state); err != nil {
+			log.Printf("skipping unreadable live room: %v", err)
+			continue
+		}
+		room := restoreRoom(state)
+		room.version = version
+		rooms = append(rooms, room)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	for _, room := range rooms {
+		s.rooms[room.code] = room
+	}
+	s.mu.Unlock()
+
+	settled := []string{}
+	for _, room := range rooms {
+		room.mu.Lock()
+		if room.tournamentMatchID != 0 && !room.recorded {
+			if s.tournamentMatchDone(room.tournamentMatchID) {
+				settled = append(settled, room.code)
+			}
+			room.mu.Unlock()
+			continue
+		}
+		for _, player := range []*Player{room.playerX, room.playerO} {
+			if player == nil || player.bot {
+				continue
+			}
+			player.disconnectTimer = time.AfterFunc(reconnectGrace, func() {
+				s.closeRoom(room, "timeout")
+			})
+		}
+		room.mu.Unlock()
+	}
+	s.closeMatchRooms(settled)
+	return len(rooms), nil
+}
+
+func (r *Room) persistedLocked() persistedRoom {
+	state := persistedRoom{
+		Code:              r.code,
+		Rules:             r.rules,
+		Board:             append([]string(nil), r.board...),
+		SubWinners:        append([]string(nil), r.subWinners...),
+		ForcedBoard:       r.forcedBoard,
+		Turn:              r.turn,
+		StartingSymbol:    r.startingSymbol,
+		Winner:            r.winner,
+		Draw:              r.draw,
+		StartedAt:         r.startedAt,
+		Moves:             append([]moveRecord(nil), r.moves...),
+		Recorded:          r.recorded,
+		BotDifficulty:     r.botDifficulty,
+		Private:           r.private,
+		PasswordHash:      r.passwordHash,
+		AllowedUserIDs:    append([]int64(nil), r.allowedUserIDs...),
+		TournamentMatchID: r.tournamentMatchID,
+		PlayerX:           persistPlayer(r.playerX),
+		PlayerO:           persistPlayer(r.playerO),
+	}
+	return state
+}
+
+func restoreRoom(state persistedRoom) *Room {
+	room := &Room{
+		code:              state.Code,
+		rules:             state.Rules,
+		board:             state.Board,
+		subWinners:        state.SubWinners,
+		forcedBoard:       state.ForcedBoard,
+		turn:              state.Turn,
+		startingSymbol:    state.StartingSymbol,
+		winner:            state.Winner,
+		draw:              state.Draw,
+		startedAt:         state.StartedAt,
+		moves:             state.Moves,
+		recorded:          state.Recorded,
+		botDifficulty:     state.BotDifficulty,
+		private:           state.Private,
+		passwordHash:      state.PasswordHash,
+		allowedUserIDs:    state.AllowedUserIDs,
+		tournamentMatchID: state.TournamentMatchID,
+		playerX:           restorePlayer(state.PlayerX),
+		playerO:           restorePlayer(state.PlayerO),
+		spectators:        make(map[string]*Player),
+	}
+	if len(room.board) != room.rules.cells() {
+		room.resetBoardLocked()
+	}
+	return room
+}
+
+func persistPlayer(player *Player) *persistedPlayer {
+	if player == nil {
+		return nil
+	}
+	return &persistedPlayer{
+		ID:     player.id,
+		Name:   player.name,
+		Symbol: player.symbol,
+		UserID: player.userID,
+		Bot:    player.bot,
+	}
+}
+
+func restorePlayer(state *persistedPlayer) *Player {
+	if state == nil {
+		return nil
+	}
+	return &Player{
+		id:        state.ID,
+		name:      state.Name,
+		symbol:    state.Symbol,
+		userID:    state.UserID,
+		bot:       state.Bot,
+		connected: state.Bot,
+	}
+}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// newTestServer returns a server backed by a fresh, fully migrated database.
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+	db, err := openDB(filepath.Join(t.TempDir(), "test.db"))
+	if err != nil {
+		t.Fatalf("open db: %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	srv := NewServer(db, nil)
+	srv.signingKey = []byte("test-signing-key")
+	return srv
+}
+
+func mustExec(t *testing.T, srv *Server, query string, args ...any) {
+	t.Helper()
+	if _, err := srv.db.Exec(query, args...); err != nil {
+		t.Fatalf("%s: %v", query, err)
+	}
+}
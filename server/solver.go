@@ -0,0 +1,90 @@
+package main
+
+import "strings"
+
+const (
+	outcomeLoss = -1
+	outcomeDraw = 0
+	outcomeWin  = 1
+)
+
+// maxSolverCells bounds the full game-tree search to boards where it stays
+// instant (3×3 has fewer than 6000 reachable positions).
+const maxSolverCells = 9
+
+type solveResult struct {
+	Outcome int
+	Plies   int
+}
+
+type solver struct {
+	rules gameRules
+	memo  map[string]solveResult
+}
+
+func canSolve(rules gameRules) bool {
+	return rules.Variant == variantClassic && rules.cells() <= maxSolverCells
+}
+
+func newSolver(rules gameRules) *solver {
+	return &solver{rules: rules, memo: make(map[string]solveResult)}
+}
+
+// solve returns the game-theoretic result for turn, the side to move, on an
+// unfinished board.
+func (sv *solver) solve(board []string, turn string) solveResult {
+	key := turn + "|" + strings.Join(board, ",")
+	if result, ok := sv.memo[key]; ok {
+		return result
+	}
+
+	var best solveResult
+	found := false
+	for cell, value := range board {
+		if value != "" {
+			continue
+		}
+		result := sv.evaluateMove(board, turn, cell)
+		if !found || result.score() > best.score() {
+			best = result
+			found = true
+		}
+	}
+
+	sv.memo[key] = best
+	return best
+}
+
+// evaluateMove returns the result for turn after it plays cell.
+func (sv *solver) evaluateMove(board []string, turn string, cell int) solveResult {
+	next := make([]string, len(board))
+	copy(next, board)
+	next[cell] = turn
+
+	position := &Room{rules: sv.rules, board: next}
+	if winner := position.checkWinner(); winner != "" {
+		if winner == turn {
+			return solveResult{Outcome: outcomeWin, Plies: 1}
+		}
+		return solveResult{Outcome: outcomeLoss, Plies: 1}
+	}
+	if position.checkDraw() {
+		return solveResult{Outcome: outcomeDraw, Plies: 1}
+	}
+
+	reply := sv.solve(next, otherSymbol(turn))
+	return solveResult{Outcome: -reply.Outcome, Plies: reply.Plies + 1}
+}
+
+// score orders results from the mover's point of view: faster wins first,
+// slower losses last.
+func (r solveResult) score() int {
+	switch r.Outcome {
+	case outcomeWin:
+		return 100 - r.Plies
+	case outcomeLoss:
+		return r.Plies - 100
+	default:
+		return 0
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestSolve(t *testing.T) {
+	tests := []struct {
+		name   string
+		rows   []string
+		turn   string
+		misere bool
+		want   solveResult
+	}{
+		{"empty board is a draw", []string{"...", "...", "..."}, symbolX, false, solveResult{Outcome: outcomeDraw, Plies: 9}},
+		{"empty misere board is a draw", []string{"...", "...", "..."}, symbolX, true, solveResult{Outcome: outcomeDraw, Plies: 9}},
+		{"immediate win", []string{"XX.", "OO.", "..."}, symbolX, false, solveResult{Outcome: outcomeWin, Plies: 1}},
+		{"fork cannot be stopped", []string{"X.X", ".O.", "O.X"}, symbolO, false, solveResult{Outcome: outcomeLoss, Plies: 2}},
+		{"last move draws", []string{"XOX", "XOO", "OX."}, symbolX, false, solveResult{Outcome: outcomeDraw, Plies: 1}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules := defaultRules()
+			rules.Misere = tt.misere
+			got := newSolver(rules).solve(parseBoard(tt.rows...), tt.turn)
+			if got.Outcome != tt.want.Outcome || (tt.want.Outcome != outcomeDraw && got.Plies != tt.want.Plies) {
+				t.Fatalf("solve() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEvaluateMoveMisere(t *testing.T) {
+	board := parseBoard("XX.", "OO.", "...")
+	for _, tt := range []struct {
+		misere bool
+		want   int
+	}{
+		{false, outcomeWin},
+		{true, outcomeLoss},
+	} {
+		rules := defaultRules()
+		rules.Misere = tt.misere
+		got := newSolver(rules).evaluateMove(board, symbolX, 2)
+		if got.Outcome != tt.want || got.Plies != 1 {
+			t.Errorf("completing the row with misere=%v = %+v, want outcome %d in 1 ply", tt.misere, got, tt.want)
+		}
+	}
+}
+
+func TestCanSolve(t *testing.T) {
+	big, _ := newGameRules(variantClassic, 4, 4, 3)
+	ultimate, _ := newGameRules(variantUltimate, 0, 0, 0)
+	for _, tt := range []struct {
+		rules gameRules
+		want  bool
+	}{
+		{defaultRules(), true},
+		{big, false},
+		{ultimate, false},
+	} {
+		if got := canSolve(tt.rules); got != tt.want {
+			t.Errorf("canSolve(%+v) = %v, want %v", tt.rules, got, tt.want)
+		}
+	}
+}
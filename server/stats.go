@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultActivityDays = 30
+	maxStatsRangeDays   = 3650
+	topOpponentsLimit   = 5
+)
+
+// statsResponse keeps the original totals over every game at the top level,
+// split into vs_bot and excluding_bots. The other breakdowns cover games
+// against humans within the requested range.
+type statsResponse struct {
+	resultCounts
+	VsBot              resultCounts    `json:"vs_bot"`
+	ExcludingBots      resultCounts    `json:"excluding_bots"`
+	Rating             *ratingInfo     `json:"rating,omitempty"`
+	Range              string          `json:"range"`
+	CurrentWinStreak   int             `json:"current_win_streak"`
+	BestWinStreak      int             `json:"best_win_streak"`
+	AsX                symbolStats     `json:"as_x"`
+	AsO                symbolStats     `json:"as_o"`
+	Starting           resultCounts    `json:"starting"`
+	NotStarting        resultCounts    `json:"not_starting"`
+	AvgDurationSeconds float64         `json:"avg_duration_seconds"`
+	GamesPerDay        []dayCount      `json:"games_per_day"`
+	TopOpponents       []opponentStats `json:"top_opponents"`
+}
+
+type symbolStats struct {
+	resultCounts
+	WinRate float64 `json:"win_rate"`
+}
+
+type dayCount struct {
+	Date  string `json:"date"`
+	Games int    `json:"games"`
+}
+
+type opponentStats struct {
+	UserID int64  `json:"user_id,omitempty"`
+	Name   string `json:"name"`
+	resultCounts
+}
+
+type statsRange struct {
+	Label string
+	Days  int
+}
+
+type statsGame struct {
+	startedAt   int64
+	endedAt     int64
+	vsBot       bool
+	yourSymbol  string
+	firstSymbol string
+	result      string
+	opponentID  int64
+	opponent    string
+}
+
+// parseStatsRange accepts "all" (the default) or a number of days such as "30d".
+func parseStatsRange(raw string) (statsRange, error) {
+	raw = strings.ToLower(strings.TrimSpace(raw))
+	if raw == "" || raw == "all" {
+		return statsRange{Label: "all"}, nil
+	}
+	days, err := strconv.Atoi(strings.TrimSuffix(raw, "d"))
+	if err != nil || !strings.HasSuffix(raw, "d") || days <= 0 || days > maxStatsRangeDays {
+		return statsRange{}, errors.New("invalid range (want all or a number of days like 30d)")
+	}
+	return statsRange{Label: raw, Days: days}, nil
+}
+
+func (c *resultCounts) add(result string) {
+	c.Total++
+	switch result {
+	case "win":
+		c.Wins++
+	case "loss":
+		c.Losses++
+	default:
+		c.Draws++
+	}
+}
+
+func (s symbolStats) withRate() symbolStats {
+	if s.Total > 0 {
+		s.WinRate = float64(s.Wins) / float64(s.Total)
+	}
+	return s
+}
+
+func (s *Server) loadStats(userID int64, window statsRange) (statsResponse, error) {
+	now := time.Now().UTC()
+	var since int64
+	if window.Days > 0 {
+		since = now.AddDate(0, 0, -window.Days).Unix()
+	}
+
+	rows, err := s.db.Query(
+		`SELECT g.started_at, g.ended_at, g.winner_symbol, g.is_draw, g.bot_level IS NOT NULL,
+		 g.player_x_user_id, g.player_o_user_id, g.player_x_name, g.player_o_name,
+		 (SELECT m.symbol FROM game_moves m WHERE m.game_id = g.id AND m.ply = 1)
+		 FROM games g
+		 WHERE (g.player_x_user_id = ? OR g.player_o_user_id = ?) AND g.ended_at >= ?
+		 ORDER BY g.ended_at ASC, g.id ASC`,
+		userID, userID, since,
+	)
+	if err != nil {
+		return statsResponse{}, err
+	}
+	defer rows.Close()
+
+	games := []statsGame{}
+	for rows.Next() {
+		var game statsGame
+		var winnerSymbol, playerXName, playerOName, firstSymbol sql.NullString
+		var playerXID, playerOID sql.NullInt64
+		var isDraw, vsBot int
+		if err := rows.Scan(&game.startedAt, &game.endedAt, &winnerSymbol, &isDraw, &vsBot, &playerXID, &playerOID, &playerXName, &playerOName, &firstSymbol); err != nil {
+			return statsResponse{}, err
+		}
+		game.vsBot = vsBot == 1
+		game.firstSymbol = firstSymbol.String
+		if playerXID.Valid && playerXID.Int64 == userID {
+			game.yourSymbol = symbolX
+			game.opponentID = nullInt(playerOID)
+			game.opponent = playerOName.String
+		} else {
+			game.yourSymbol = symbolO
+			game.opponentID = nullInt(playerXID)
+			game.opponent = playerXName.String
+		}
+		switch {
+		case isDraw == 1:
+			game.result = "draw"
+		case winnerSymbol.String == game.yourSymbol:
+			game.result = "win"
+		default:
+			game.result = "loss"
+		}
+		games = append(games, game)
+	}
+	if err := rows.Err(); err != nil {
+		return statsResponse{}, err
+	}
+
+	rating, err := s.loadRating(userID)
+	if err != nil {
+		return statsResponse{}, err
+	}
+
+	activityDays := window.Days
+	if activityDays == 0 {
+		activityDays = defaultActivityDays
+	}
+	stats := buildStats(games, window.Label, activityDays, now)
+	stats.Rating = rating
+	return stats, nil
+}
+
+// buildStats expects games ordered oldest first.
+func buildStats(games []statsGame, label string, activityDays int, now time.Time) statsResponse {
+	stats := statsResponse{Range: label, TopOpponents: []opponentStats{}}
+
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	firstDay := today.AddDate(0, 0, -(activityDays - 1))
+	perDay := make([]int, activityDays)
+
+	opponents := make(map[string]*opponentStats)
+	var durationTotal, durationGames int64
+	streak := 0
+	for _, game := range games {
+		stats.resultCounts.add(game.result)
+		if game.vsBot {
+			stats.VsBot.add(game.result)
+			continue
+		}
+		stats.ExcludingBots.add(game.result)
+
+		if game.result == "win" {
+			streak++
+			stats.BestWinStreak = max(stats.BestWinStreak, streak)
+		} else {
+			streak = 0
+		}
+
+		if game.yourSymbol == symbolX {
+			stats.AsX.add(game.result)
+		} else {
+			stats.AsO.add(game.result)
+		}
+
+		if game.firstSymbol == game.yourSymbol {
+			stats.Starting.add(game.result)
+		} else if game.firstSymbol != "" {
+			stats.NotStarting.add(game.result)
+		}
+
+		if game.endedAt >= game.startedAt {
+			durationTotal += game.endedAt - game.startedAt
+			durationGames++
+		}
+
+		if ended := time.Unix(game.endedAt, 0).UTC(); !ended.Before(firstDay) {
+			if day := int(ended.Sub(firstDay) / (24 * time.Hour)); day < activityDays {
+				perDay[day]++
+			}
+		}
+
+		key := "name:" + game.opponent
+		if game.opponentID != 0 {
+			key = "id:" + strconv.FormatInt(game.opponentID, 10)
+		}
+		opponent, ok := opponents[key]
+		if !ok {
+			opponent = &opponentStats{UserID: game.opponentID}
+			opponents[key] = opponent
+		}
+		opponent.Name = game.opponent
+		opponent.add(game.result)
+	}
+
+	stats.CurrentWinStreak = streak
+	stats.AsX = stats.AsX.withRate()
+	stats.AsO = stats.AsO.withRate()
+	if durationGames > 0 {
+		stats.AvgDurationSeconds = float64(durationTotal) / float64(durationGames)
+	}
+
+	stats.GamesPerDay = make([]dayCount, activityDays)
+	for i := range perDay {
+		stats.GamesPerDay[i] = dayCount{Date: firstDay.AddDate(0, 0, i).Format(time.DateOnly), Games: perDay[i]}
+	}
+
+	for _, opponent := range opponents {
+		stats.TopOpponents = append(stats.TopOpponents, *opponent)
+	}
+	sort.Slice(stats.TopOpponents, func(i, j int) bool {
+		a, b := stats.TopOpponents[i], stats.TopOpponents[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		}
+		return a.Name < b.Name
+	})
+	if len(stats.TopOpponents) > topOpponentsLimit {
+		stats.TopOpponents = stats.TopOpponents[:topOpponentsLimit]
+	}
+	return stats
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"strings"
+)
+
+const signingKeySize = 32
+
+var errInvalidToken = errors.New("invalid token")
+
+// loadSigningKey returns the key used for server-signed tokens. TOKEN_SECRET
+// wins when set; otherwise a random key is generated once and kept in the
+// database so tokens survive restarts.
+func loadSigningKey(db *sql.DB) ([]byte, error) {
+	if secret := strings.TrimSpace(os.Getenv("TOKEN_SECRET")); secret != "" {
+		return []byte(secret), nil
+	}
+
+	var encoded string
+	err := db.QueryRow("SELECT value FROM server_keys WHERE name = 'signing'").Scan(&encoded)
+	if errors.Is(err, sql.ErrNoRows) {
+		key := make([]byte, signingKeySize)
+		if _, err := rand.Read(key); err != nil {
+			return nil, err
+		}
+		if _, err := db.Exec(
+			"INSERT INTO server_keys (name, value, created_at) VALUES ('signing', ?, ?) ON CONFLICT(name) DO NOTHING",
+			base64.RawURLEncoding.EncodeToString(key), nowUnix(),
+		); err != nil {
+			return nil, err
+		}
+		err = db.QueryRow("SELECT value FROM server_keys WHERE name = 'signing'").Scan(&encoded)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(encoded)
+}
+
+// signToken encodes claims as base64url JSON followed by an HMAC-SHA256 over
+// the purpose and the encoded claims, so a token minted for one purpose is
+// useless for another.
+func signToken(key []byte, purpose string, claims any) (string, error) {
+	data, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(data)
+	return body + "." + base64.RawURLEncoding.EncodeToString(tokenMAC(key, purpose, body)), nil
+}
+
+func verifyToken(key []byte, purpose, token string, claims any) error {
+	body, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return errInvalidToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(sig)
+	if err != nil || !hmac.Equal(mac, tokenMAC(key, purpose, body)) {
+		return errInvalidToken
+	}
+	data, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return errInvalidToken
+	}
+	if err := json.Unmarshal(data, claims); err != nil {
+		return errInvalidToken
+	}
+	return nil
+}
+
+func tokenMAC(key []byte, purpose, body string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(purpose))
+	mac.Write([]byte{0})
+	mac.Write([]byte(body))
+	return mac.Sum(nil)
+}
@@ -0,0 +1,954 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	formatSingleElimination = "single_elimination"
+	formatRoundRobin        = "round_robin"
+	formatSwiss             = "swiss"
+)
+
+const (
+	tournamentRegistration = "registration"
+	tournamentRunning      = "running"
+	tournamentFinished     = "finished"
+
+	matchPlaying  = "playing"
+	matchFinished = "finished"
+)
+
+const (
+	minTournamentPlayers     = 2
+	defaultTournamentPlayers = 16
+	maxTournamentPlayers     = 128
+	maxTournamentNameLength  = 64
+	tournamentListLimit      = 50
+)
+
+var (
+	errTournamentNotFound = errors.New("tournament not found")
+	errTournamentClosed   = errors.New("tournament registration is closed")
+	errTournamentFull     = errors.New("tournament is full")
+	errAlreadyRegistered  = errors.New("already registered")
+	errNotRegistered      = errors.New("not registered")
+	errNotOrganizer       = errors.New("only the organizer can do that")
+)
+
+type createTournamentPayload struct {
+	Name       string `json:"name"`
+	Format     string `json:"format"`
+	Variant    string `json:"variant,omitempty"`
+	Width      int    `json:"width,omitempty"`
+	Height     int    `json:"height,omitempty"`
+	WinLength  int    `json:"win_length,omitempty"`
+	Misere     bool   `json:"misere,omitempty"`
+	MaxPlayers int    `json:"max_players,omitempty"`
+	Rounds     int    `json:"rounds,omitempty"`
+}
+
+type matchResultPayload struct {
+	WinnerUserID int64 `json:"winner_user_id,omitempty"`
+	Draw         bool  `json:"draw,omitempty"`
+}
+
+type watchTournamentPayload struct {
+	TournamentID int64 `json:"tournament_id"`
+}
+
+type tournament struct {
+	ID           int64     `json:"id"`
+	Name         string    `json:"name"`
+	Format       string    `json:"format"`
+	Status       string    `json:"status"`
+	Rules        gameRules `json:"rules"`
+	MaxPlayers   int       `json:"max_players"`
+	Rounds       int       `json:"rounds"`
+	CurrentRound int       `json:"current_round"`
+	CreatedBy    int64     `json:"created_by"`
+	CreatedAt    int64     `json:"created_at"`
+	StartedAt    int64     `json:"started_at,omitempty"`
+	FinishedAt   int64     `json:"finished_at,omitempty"`
+}
+
+type tournamentPlayer struct {
+	UserID int64  `json:"user_id"`
+	Name   string `json:"name"`
+	Seed   int    `json:"seed,omitempty"`
+}
+
+type tournamentMatch struct {
+	ID        int64  `json:"id"`
+	Round     int    `json:"round"`
+	Slot      int    `json:"slot"`
+	PlayerXID int64  `json:"player_x_user_id"`
+	PlayerOID int64  `json:"player_o_user_id,omitempty"`
+	RoomCode  string `json:"room_code,omitempty"`
+	GameID    int64  `json:"game_id,omitempty"`
+	WinnerID  int64  `json:"winner_user_id,omitempty"`
+	IsDraw    bool   `json:"is_draw"`
+	Status    string `json:"status"`
+}
+
+type tournamentStanding struct {
+	Rank            int     `json:"rank"`
+	UserID          int64   `json:"user_id"`
+	Name            string  `json:"name"`
+	Played          int     `json:"played"`
+	Wins            int     `json:"wins"`
+	Draws           int     `json:"draws"`
+	Losses          int     `json:"losses"`
+	Byes            int     `json:"byes"`
+	Points          float64 `json:"points"`
+	Buchholz        float64 `json:"buchholz"`
+	SonnebornBerger float64 `json:"sonneborn_berger"`
+	Eliminated      bool    `json:"eliminated,omitempty"`
+}
+
+type tournamentDetail struct {
+	tournament
+	Players   []tournamentPlayer   `json:"players"`
+	Matches   []tournamentMatch    `json:"matches"`
+	Standings []tournamentStanding `json:"standings"`
+}
+
+type tournamentListResponse struct {
+	Tournaments []tournament `json:"tournaments"`
+}
+
+// tournamentHub serialises registration, starts and round changes, and keeps
+// the sessions watching each tournament.
+type tournamentHub struct {
+	mu          sync.Mutex
+	feedMu      sync.Mutex
+	subscribers map[int64]map[*Session]bool
+}
+
+func (s *Server) handleTournaments(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := s.loadTournaments()
+		if err != nil {
+			log.Printf("tournament list failed: %v", err)
+			http.Error(w, "tournaments failed", http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, tournamentListResponse{Tournaments: list}, http.StatusOK)
+	case http.MethodPost:
+		user, err := s.userFromRequest(r)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var payload createTournamentPayload
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&payload); err != nil {
+			http.Error(w, "invalid tournament payload", http.StatusBadRequest)
+			return
+		}
+		t, err := newTournament(payload, user.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		id, err := s.insertTournament(t)
+		if err != nil {
+			log.Printf("tournament create failed: %v", err)
+			http.Error(w, "tournament failed", http.StatusInternalServerError)
+			return
+		}
+		s.writeTournament(w, id, http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (s *Server) handleTournament(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid tournament id", http.StatusBadRequest)
+		return
+	}
+	s.writeTournament(w, id, http.StatusOK)
+}
+
+func (s *Server) handleTournamentRegister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := s.userFromRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid tournament id", http.StatusBadRequest)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		err = s.registerForTournament(id, user)
+	} else {
+		err = s.withdrawFromTournament(id, user.ID)
+	}
+	if err != nil {
+		writeTournamentError(w, err)
+		return
+	}
+	s.publishTournament(id)
+	s.writeTournament(w, id, http.StatusOK)
+}
+
+func (s *Server) handleTournamentStart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := s.userFromRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid tournament id", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.startTournament(id, user.ID); err != nil {
+		writeTournamentError(w, err)
+		return
+	}
+	s.publishTournament(id)
+	s.writeTournament(w, id, http.StatusOK)
+}
+
+// handleMatchResult lets the organizer settle a match by hand, for no-shows
+// or a room that closed before the game finished.
+func (s *Server) handleMatchResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	user, err := s.userFromRequest(r)
+	if err != nil {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid tournament id", http.StatusBadRequest)
+		return
+	}
+	matchID, err := strconv.ParseInt(r.PathValue("match"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid match id", http.StatusBadRequest)
+		return
+	}
+	var payload matchResultPayload
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxMessageSize)).Decode(&payload); err != nil {
+		http.Error(w, "invalid result payload", http.StatusBadRequest)
+		return
+	}
+
+	if err := s.settleMatch(id, matchID, user.ID, payload); err != nil {
+		writeTournamentError(w, err)
+		return
+	}
+	s.tournamentChanged(id)
+	s.writeTournament(w, id, http.StatusOK)
+}
+
+func writeTournamentError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errTournamentNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, errNotOrganizer):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	case errors.Is(err, errTournamentClosed), errors.Is(err, errTournamentFull), errors.Is(err, errAlreadyRegistered), errors.Is(err, errNotRegistered):
+		http.Error(w, err.Error(), http.StatusConflict)
+	default:
+		var invalid *tournamentInputError
+		if errors.As(err, &invalid) {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("tournament update failed: %v", err)
+		http.Error(w, "tournament failed", http.StatusInternalServerError)
+	}
+}
+
+// tournamentInputError marks a request the caller can fix.
+type tournamentInputError struct {
+	message string
+}
+
+func (e *tournamentInputError) Error() string {
+	return e.message
+}
+
+func (s *Server) writeTournament(w http.ResponseWriter, id int64, status int) {
+	detail, err := s.loadTournamentDetail(id)
+	if err != nil {
+		writeTournamentError(w, err)
+		return
+	}
+	writeJSON(w, detail, status)
+}
+
+func newTournament(payload createTournamentPayload, createdBy int64) (tournament, error) {
+	name := strings.TrimSpace(payload.Name)
+	if name == "" || len(name) > maxTournamentNameLength {
+		return tournament{}, errors.New("tournament name must be 1 to 64 characters")
+	}
+	switch payload.Format {
+	case formatSingleElimination, formatRoundRobin, formatSwiss:
+	default:
+		return tournament{}, errors.New("unknown tournament format")
+	}
+	rules, err := newGameRules(payload.Variant, payload.Width, payload.Height, payload.WinLength)
+	if err != nil {
+		return tournament{}, err
+	}
+	rules.Misere = payload.Misere
+
+	maxPlayers := payload.MaxPlayers
+	if maxPlayers == 0 {
+		maxPlayers = defaultTournamentPlayers
+	}
+	if maxPlayers < minTournamentPlayers || maxPlayers > maxTournamentPlayers {
+		return tournament{}, fmt.Errorf("max_players must be between %d and %d", minTournamentPlayers, maxTournamentPlayers)
+	}
+	if payload.Rounds < 0 || (payload.Rounds > 0 && payload.Format != formatSwiss) {
+		return tournament{}, errors.New("rounds can only be set for swiss tournaments")
+	}
+
+	return tournament{
+		Name:       name,
+		Format:     payload.Format,
+		Status:     tournamentRegistration,
+		Rules:      rules,
+		MaxPlayers: maxPlayers,
+		Rounds:     payload.Rounds,
+		CreatedBy:  createdBy,
+		CreatedAt:  nowUnix(),
+	}, nil
+}
+
+func (s *Server) insertTournament(t tournament) (int64, error) {
+	res, err := s.db.Exec(
+		`INSERT INTO tournaments (name, format, status, variant, width, height, win_length, misere, max_players, rounds, current_round, created_by, created_at)
+		 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, 0, ?, ?)`,
+		t.Name, t.Format, t.Status, t.Rules.Variant, t.Rules.Width, t.Rules.Height, t.Rules.WinLength, boolToInt(t.Rules.Misere), t.MaxPlayers, t.Rounds, t.CreatedBy, t.CreatedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+const tournamentColumns = `id, name, format, status, variant, width, height, win_length, misere, max_players, rounds, current_round, created_by, created_at, started_at, finished_at`
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanTournament(row rowScanner) (tournament, error) {
+	var t tournament
+	var misere int
+	var startedAt, finishedAt sql.NullInt64
+	if err := row.Scan(&t.ID, &t.Name, &t.Format, &t.Status, &t.Rules.Variant, &t.Rules.Width, &t.Rules.Height, &t.Rules.WinLength, &misere, &t.MaxPlayers, &t.Rounds, &t.CurrentRound, &t.CreatedBy, &t.CreatedAt, &startedAt, &finishedAt); err != nil {
+		return tournament{}, err
+	}
+	t.Rules.Misere = misere == 1
+	t.StartedAt = nullInt(startedAt)
+	t.FinishedAt = nullInt(finishedAt)
+	return t, nil
+}
+
+func (s *Server) loadTournaments() ([]tournament, error) {
+	rows, err := s.db.Query("SELECT "+tournamentColumns+" FROM tournaments ORDER BY id DESC LIMIT ?", tournamentListLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []tournament{}
+	for rows.Next() {
+		t, err := scanTournament(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func (s *Server) loadTournament(id int64) (tournament, error) {
+	t, err := scanTournament(s.db.QueryRow("SELECT "+tournamentColumns+" FROM tournaments WHERE id = ?", id))
+	if errors.Is(err, sql.ErrNoRows) {
+		return tournament{}, errTournamentNotFound
+	}
+	return t, err
+}
+
+func (s *Server) loadTournamentDetail(id int64) (tournamentDetail, error) {
+	t, err := s.loadTournament(id)
+	if err != nil {
+		return tournamentDetail{}, err
+	}
+	detail := tournamentDetail{tournament: t, Players: []tournamentPlayer{}, Matches: []tournamentMatch{}}
+
+	rows, err := s.db.Query(
+		"SELECT user_id, name, seed FROM tournament_players WHERE tournament_id = ? ORDER BY seed, registered_at, user_id",
+		id,
+	)
+	if err != nil {
+		return tournamentDetail{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var player tournamentPlayer
+		if err := rows.Scan(&player.UserID, &player.Name, &player.Seed); err != nil {
+			return tournamentDetail{}, err
+		}
+		detail.Players = append(detail.Players, player)
+	}
+	if err := rows.Err(); err != nil {
+		return tournamentDetail{}, err
+	}
+
+	matchRows, err := s.db.Query(
+		`SELECT id, round, slot, player_x_user_id, player_o_user_id, room_code, game_id, winner_user_id, is_draw, status
+		 FROM tournament_matches WHERE tournament_id = ? ORDER BY round, slot`,
+		id,
+	)
+	if err != nil {
+		return tournamentDetail{}, err
+	}
+	defer matchRows.Close()
+	for matchRows.Next() {
+		var match tournamentMatch
+		var playerOID, gameID, winnerID sql.NullInt64
+		var roomCode sql.NullString
+		var isDraw int
+		if err := matchRows.Scan(&match.ID, &match.Round, &match.Slot, &match.PlayerXID, &playerOID, &roomCode, &gameID, &winnerID, &isDraw, &match.Status); err != nil {
+			return tournamentDetail{}, err
+		}
+		match.PlayerOID = nullInt(playerOID)
+		match.RoomCode = roomCode.String
+		match.GameID = nullInt(gameID)
+		match.WinnerID = nullInt(winnerID)
+		match.IsDraw = isDraw == 1
+		detail.Matches = append(detail.Matches, match)
+	}
+	if err := matchRows.Err(); err != nil {
+		return tournamentDetail{}, err
+	}
+
+	detail.Standings = computeStandings(t.Format, detail.Players, detail.Matches)
+	return detail, nil
+}
+
+func (s *Server) registerForTournament(id int64, user User) error {
+	if user.IsGuest {
+		return &tournamentInputError{message: "guests cannot join tournaments"}
+	}
+	s.tournaments.mu.Lock()
+	defer s.tournaments.mu.Unlock()
+
+	t, err := s.loadTournament(id)
+	if err != nil {
+		return err
+	}
+	if t.Status != tournamentRegistration {
+		return errTournamentClosed
+	}
+	return withTx(s.db, func(tx *sql.Tx) error {
+		var count int
+		if err := tx.QueryRow("SELECT COUNT(*) FROM tournament_players WHERE tournament_id = ?", id).Scan(&count); err != nil {
+			return err
+		}
+		if count >= t.MaxPlayers {
+			return errTournamentFull
+		}
+		res, err := tx.Exec(
+			`INSERT INTO tournament_players (tournament_id, user_id, name, seed, registered_at) VALUES (?, ?, ?, 0, ?)
+			 ON CONFLICT(tournament_id, user_id) DO NOTHING`,
+			id, user.ID, user.Username, nowUnix(),
+		)
+		if err != nil {
+			return err
+		}
+		if affected, err := res.RowsAffected(); err != nil {
+			return err
+		} else if affected == 0 {
+			return errAlreadyRegistered
+		}
+		return nil
+	})
+}
+
+func (s *Server) withdrawFromTournament(id, userID int64) error {
+	s.tournaments.mu.Lock()
+	defer s.tournaments.mu.Unlock()
+
+	t, err := s.loadTournament(id)
+	if err != nil {
+		return err
+	}
+	if t.Status != tournamentRegistration {
+		return errTournamentClosed
+	}
+	res, err := s.db.Exec("DELETE FROM tournament_players WHERE tournament_id = ? AND user_id = ?", id, userID)
+	if err != nil {
+		return err
+	}
+	if affected, err := res.RowsAffected(); err != nil {
+		return err
+	} else if affected == 0 {
+		return errNotRegistered
+	}
+	return nil
+}
+
+// startTournament closes registration, seeds players by rating (then by
+// registration order) and opens the first round.
+func (s *Server) startTournament(id, userID int64) error {
+	s.tournaments.mu.Lock()
+	defer s.tournaments.mu.Unlock()
+
+	detail, err := s.loadTournamentDetail(id)
+	if err != nil {
+		return err
+	}
+	if detail.CreatedBy != userID {
+		return errNotOrganizer
+	}
+	if detail.Status != tournamentRegistration {
+		return errTournamentClosed
+	}
+	if len(detail.Players) < minTournamentPlayers {
+		return &tournamentInputError{message: "not enough players"}
+	}
+
+	seeded, err := s.seedPlayers(id)
+	if err != nil {
+		return err
+	}
+	detail.Players = seeded
+	detail.Rounds = totalRounds(detail.Format, len(seeded), detail.Rounds)
+
+	ids := make([]int64, len(seeded))
+	for i, player := range seeded {
+		ids[i] = player.UserID
+	}
+	var pairings []pairing
+	switch detail.Format {
+	case formatSingleElimination:
+		pairings = eliminationFirstRound(ids)
+	case formatRoundRobin:
+		pairings = roundRobinRound(ids, 1)
+	default:
+		pairings = swissRound(computeStandings(detail.Format, seeded, nil), nil)
+	}
+
+	now := nowUnix()
+	return s.openRound(detail, 1, pairings, func(tx *sql.Tx) error {
+		for _, player := range seeded {
+			if _, err := tx.Exec("UPDATE tournament_players SET seed = ? WHERE tournament_id = ? AND user_id = ?", player.Seed, id, player.UserID); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec(
+			"UPDATE tournaments SET status = ?, rounds = ?, started_at = ? WHERE id = ?",
+			tournamentRunning, detail.Rounds, now, id,
+		)
+		return err
+	})
+}
+
+func (s *Server) seedPlayers(id int64) ([]tournamentPlayer, error) {
+	rows, err := s.db.Query(
+		`SELECT p.user_id, p.name
+		 FROM tournament_players p
+		 LEFT JOIN ratings r ON r.user_id = p.user_id
+		 WHERE p.tournament_id = ?
+		 ORDER BY COALESCE(r.rating, ?) DESC, p.registered_at, p.user_id`,
+		id, initialRating,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	players := []tournamentPlayer{}
+	for rows.Next() {
+		player := tournamentPlayer{Seed: len(players) + 1}
+		if err := rows.Scan(&player.UserID, &player.Name); err != nil {
+			return nil, err
+		}
+		players = append(players, player)
+	}
+	return players, rows.Err()
+}
+
+// openRound stores the round's matches and then opens a room per real match
+// with both seats reserved for the paired users. Byes are finished at once.
+// extra runs in the same transaction.
+func (s *Server) openRound(detail tournamentDetail, round int, pairings []pairing, extra func(tx *sql.Tx) error) error {
+	names := make(map[int64]string, len(detail.Players))
+	for _, player := range detail.Players {
+		names[player.UserID] = player.Name
+	}
+
+	codes := make([]string, len(pairings))
+	for i, p := range pairings {
+		if p.O != 0 {
+			codes[i] = s.uniqueRoomCode()
+		}
+	}
+
+	matchIDs := make([]int64, len(pairings))
+	now := nowUnix()
+	err := withTx(s.db, func(tx *sql.Tx) error {
+		if extra != nil {
+			if err := extra(tx); err != nil {
+				return err
+			}
+		}
+		for i, p := range pairings {
+			status, winner := matchPlaying, sql.NullInt64{}
+			var finishedAt any
+			if p.O == 0 {
+				status, winner, finishedAt = matchFinished, sql.NullInt64{Int64: p.X, Valid: true}, now
+			}
+			res, err := tx.Exec(
+				`INSERT INTO tournament_matches (tournament_id, round, slot, player_x_user_id, player_o_user_id, room_code, winner_user_id, status, created_at, finished_at)
+				 VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				detail.ID, round, i+1, p.X, nullIfZero(p.O), nullIfEmpty(codes[i]), winner, status, now, finishedAt,
+			)
+			if err != nil {
+				return err
+			}
+			if matchIDs[i], err = res.LastInsertId(); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Exec("UPDATE tournaments SET current_round = ? WHERE id = ?", round, detail.ID)
+		return err
+	})
+	if err != nil {
+		s.releaseRoomCodes(codes)
+		return err
+	}
+
+	for i, p := range pairings {
+		if p.O == 0 {
+			continue
+		}
+		room := newTournamentRoom(codes[i], matchIDs[i], detail.Rules,
+			tournamentPlayer{UserID: p.X, Name: names[p.X]},
+			tournamentPlayer{UserID: p.O, Name: names[p.O]},
+		)
+		s.addRoom(room)
+	}
+	return nil
+}
+
+// newTournamentRoom seats both players up front without a connection; each
+// claims their seat by joining the room code while signed in.
+func newTournamentRoom(code string, matchID int64, rules gameRules, x, o tournamentPlayer) *Room {
+	room := &Room{
+		code:              code,
+		rules:             rules,
+		turn:              symbolX,
+		startingSymbol:    symbolX,
+		startedAt:         time.Now().UTC(),
+		playerX:           &Player{id: randomID(), name: x.Name, symbol: symbolX, userID: x.UserID},
+		playerO:           &Player{id: randomID(), name: o.Name, symbol: symbolO, userID: o.UserID},
+		spectators:        make(map[string]*Player),
+		tournamentMatchID: matchID,
+	}
+	room.resetBoardLocked()
+	return room
+}
+
+// startTournamentGameLocked restarts the clock of an unplayed tournament game
+// once both reserved seats are taken, so the recorded duration leaves out the
+// wait for the players.
+func (r *Room) startTournamentGameLocked() {
+	if r.tournamentMatchID == 0 || len(r.moves) > 0 || r.winner != "" || r.draw {
+		return
+	}
+	if playerConnected(r.playerX) && playerConnected(r.playerO) {
+		r.startedAt = time.Now().UTC()
+	}
+}
+
+// ingestTournamentGame settles the match a finished game belongs to, inside
+// recordGame's transaction. Draws do not settle a single elimination match:
+// the players rematch in the same room. It returns the tournament id when
+// the match was settled and 0 otherwise.
+func ingestTournamentGame(tx *sql.Tx, matchID, gameID int64, record gameRecord) (int64, error) {
+	var tournamentID, playerXID int64
+	var playerOID sql.NullInt64
+	var status, format string
+	err := tx.QueryRow(
+		`SELECT m.tournament_id, m.player_x_user_id, m.player_o_user_id, m.status, t.format
+		 FROM tournament_matches m
+		 JOIN tournaments t ON t.id = m.tournament_id
+		 WHERE m.id = ?`,
+		matchID,
+	).Scan(&tournamentID, &playerXID, &playerOID, &status, &format)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	if status == matchFinished {
+		return 0, nil
+	}
+
+	var winner int64
+	if !record.IsDraw {
+		winner = record.PlayerXID
+		if record.WinnerSymbol == symbolO {
+			winner = record.PlayerOID
+		}
+		if winner == 0 || (winner != playerXID && winner != nullInt(playerOID)) {
+			return 0, nil
+		}
+	} else if format == formatSingleElimination {
+		return 0, nil
+	}
+
+	if err := finishMatch(tx, matchID, gameID, winner); err != nil {
+		return 0, err
+	}
+	return tournamentID, nil
+}
+
+func finishMatch(tx *sql.Tx, matchID, gameID, winner int64) error {
+	_, err := tx.Exec(
+		`UPDATE tournament_matches SET status = ?, game_id = ?, winner_user_id = ?, is_draw = ?, finished_at = ?
+		 WHERE id = ? AND status != ?`,
+		matchFinished, nullIfZero(gameID), nullIfZero(winner), boolToInt(winner == 0), nowUnix(), matchID, matchFinished,
+	)
+	return err
+}
+
+func (s *Server) settleMatch(id, matchID, userID int64, payload matchResultPayload) error {
+	t, err := s.loadTournament(id)
+	if err != nil {
+		return err
+	}
+	if t.CreatedBy != userID {
+		return errNotOrganizer
+	}
+
+	var playerXID int64
+	var playerOID sql.NullInt64
+	var roomCode sql.NullString
+	var status string
+	err = s.db.QueryRow(
+		"SELECT player_x_user_id, player_o_user_id, room_code, status FROM tournament_matches WHERE id = ? AND tournament_id = ?",
+		matchID, id,
+	).Scan(&playerXID, &playerOID, &roomCode, &status)
+	if errors.Is(err, sql.ErrNoRows) {
+		return &tournamentInputError{message: "match not found"}
+	}
+	if err != nil {
+		return err
+	}
+	if status == matchFinished {
+		return &tournamentInputError{message: "match already finished"}
+	}
+
+	switch {
+	case payload.Draw && payload.WinnerUserID != 0:
+		return &tournamentInputError{message: "set either winner_user_id or draw"}
+	case payload.Draw && t.Format == formatSingleElimination:
+		return &tournamentInputError{message: "elimination matches need a winner"}
+	case !payload.Draw && payload.WinnerUserID != playerXID && payload.WinnerUserID != nullInt(playerOID):
+		return &tournamentInputError{message: "winner must be one of the match players"}
+	}
+
+	err = withTx(s.db, func(tx *sql.Tx) error {
+		return finishMatch(tx, matchID, 0, payload.WinnerUserID)
+	})
+	if err != nil {
+		return err
+	}
+	if roomCode.Valid {
+		s.closeMatchRooms([]string{roomCode.String})
+	}
+	return nil
+}
+
+func (s *Server) tournamentMatchDone(matchID int64) bool {
+	var status string
+	if err := s.db.QueryRow("SELECT status FROM tournament_matches WHERE id = ?", matchID).Scan(&status); err != nil {
+		return false
+	}
+	return status == matchFinished
+}
+
+// closeMatchRooms closes the rooms of settled matches whose game was never
+// recorded. Their seats stay reserved without a timeout, so nothing else would
+// close them; rooms with a finished game close as their players leave.
+func (s *Server) closeMatchRooms(codes []string) {
+	for _, code := range codes {
+		room := s.getRoom(code)
+		if room == nil {
+			continue
+		}
+		room.mu.Lock()
+		pending := room.tournamentMatchID != 0 && !room.recorded
+		room.mu.Unlock()
+		if pending {
+			s.closeRoom(room, "settled")
+		}
+	}
+}
+
+// tournamentChanged opens the next round or finishes the tournament once the
+// current round is complete, then pushes the new state to watchers.
+func (s *Server) tournamentChanged(id int64) {
+	if err := s.advanceTournament(id); err != nil {
+		log.Printf("tournament %d advance failed: %v", id, err)
+	}
+	s.publishTournament(id)
+}
+
+func (s *Server) advanceTournament(id int64) error {
+	s.tournaments.mu.Lock()
+	defer s.tournaments.mu.Unlock()
+
+	detail, err := s.loadTournamentDetail(id)
+	if err != nil {
+		return err
+	}
+	if detail.Status != tournamentRunning {
+		return nil
+	}
+	current := []tournamentMatch{}
+	for _, match := range detail.Matches {
+		if match.Round != detail.CurrentRound {
+			continue
+		}
+		if match.Status != matchFinished {
+			return nil
+		}
+		current = append(current, match)
+	}
+
+	if detail.CurrentRound >= detail.Rounds {
+		if _, err := s.db.Exec("UPDATE tournaments SET status = ?, finished_at = ? WHERE id = ?", tournamentFinished, nowUnix(), id); err != nil {
+			return err
+		}
+		codes := []string{}
+		for _, match := range detail.Matches {
+			if match.RoomCode != "" {
+				codes = append(codes, match.RoomCode)
+			}
+		}
+		s.closeMatchRooms(codes)
+		return nil
+	}
+
+	next := detail.CurrentRound + 1
+	var pairings []pairing
+	switch detail.Format {
+	case formatSingleElimination:
+		sort.Slice(current, func(i, j int) bool { return current[i].Slot < current[j].Slot })
+		pairings = eliminationNextRound(current)
+	case formatRoundRobin:
+		ids := make([]int64, len(detail.Players))
+		for i, player := range detail.Players {
+			ids[i] = player.UserID
+		}
+		pairings = roundRobinRound(ids, next)
+	default:
+		pairings = swissRound(detail.Standings, detail.Matches)
+	}
+	return s.openRound(detail, next, pairings, nil)
+}
+
+func (s *Server) subscribeTournament(session *Session, payload watchTournamentPayload) error {
+	detail, err := s.loadTournamentDetail(payload.TournamentID)
+	if err != nil {
+		if !errors.Is(err, errTournamentNotFound) {
+			log.Printf("tournament load failed: %v", err)
+		}
+		return errTournamentNotFound
+	}
+
+	s.tournaments.feedMu.Lock()
+	if s.tournaments.subscribers == nil {
+		s.tournaments.subscribers = make(map[int64]map[*Session]bool)
+	}
+	if s.tournaments.subscribers[payload.TournamentID] == nil {
+		s.tournaments.subscribers[payload.TournamentID] = make(map[*Session]bool)
+	}
+	s.tournaments.subscribers[payload.TournamentID][session] = true
+	s.tournaments.feedMu.Unlock()
+
+	_ = session.writer.send(newMessage("tournament", detail))
+	return nil
+}
+
+// unsubscribeTournament drops the session from one tournament, or from all of
+// them when id is 0.
+func (s *Server) unsubscribeTournament(session *Session, id int64) {
+	s.tournaments.feedMu.Lock()
+	defer s.tournaments.feedMu.Unlock()
+	for tournamentID, subscribers := range s.tournaments.subscribers {
+		if id != 0 && tournamentID != id {
+			continue
+		}
+		delete(subscribers, session)
+		if len(subscribers) == 0 {
+			delete(s.tournaments.subscribers, tournamentID)
+		}
+	}
+}
+
+func (s *Server) publishTournament(id int64) {
+	s.tournaments.feedMu.Lock()
+	subscribers := make([]*Session, 0, len(s.tournaments.subscribers[id]))
+	for session := range s.tournaments.subscribers[id] {
+		subscribers = append(subscribers, session)
+	}
+	s.tournaments.feedMu.Unlock()
+	if len(subscribers) == 0 {
+		return
+	}
+
+	detail, err := s.loadTournamentDetail(id)
+	if err != nil {
+		log.Printf("tournament %d publish failed: %v", id, err)
+		return
+	}
+	msg := newMessage("tournament", detail)
+	for _, session := range subscribers {
+		_ = session.writer.send(msg)
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"math/bits"
+	"sort"
+)
+
+// pairing is one match of a round; an O of 0 is a bye for X.
+type pairing struct {
+	X int64
+	O int64
+}
+
+// totalRounds is fixed when the tournament starts.
+func totalRounds(format string, players, swissRounds int) int {
+	switch format {
+	case formatSingleElimination:
+		return bits.Len(uint(bracketSize(players) - 1))
+	case formatRoundRobin:
+		if players%2 == 0 {
+			return players - 1
+		}
+		return players
+	default:
+		rounds := swissRounds
+		if rounds <= 0 {
+			rounds = bits.Len(uint(players - 1))
+		}
+		return max(1, min(rounds, players-1))
+	}
+}
+
+func bracketSize(players int) int {
+	size := 1
+	for size < players {
+		size *= 2
+	}
+	return size
+}
+
+// bracketOrder returns seed numbers (1-based) in bracket position order so
+// that seeds 1 and 2 can only meet in the final.
+func bracketOrder(size int) []int {
+	order := []int{1}
+	for len(order) < size {
+		next := make([]int, 0, len(order)*2)
+		for _, seed := range order {
+			next = append(next, seed, len(order)*2+1-seed)
+		}
+		order = next
+	}
+	return order
+}
+
+// eliminationFirstRound pairs players (sorted by seed) along the bracket.
+// Missing seeds become byes for the top seeds.
+func eliminationFirstRound(seeded []int64) []pairing {
+	order := bracketOrder(bracketSize(len(seeded)))
+	pairings := make([]pairing, 0, len(order)/2)
+	for i := 0; i < len(order); i += 2 {
+		a, b := order[i], order[i+1]
+		if a > b {
+			a, b = b, a
+		}
+		p := pairing{X: seeded[a-1]}
+		if b <= len(seeded) {
+			p.O = seeded[b-1]
+		}
+		pairings = append(pairings, p)
+	}
+	return pairings
+}
+
+// eliminationNextRound pairs the winners of consecutive matches of the
+// previous round, which must be ordered by slot.
+func eliminationNextRound(previous []tournamentMatch) []pairing {
+	pairings := make([]pairing, 0, len(previous)/2)
+	for i := 0; i+1 < len(previous); i += 2 {
+		pairings = append(pairings, pairing{X: previous[i].WinnerID, O: previous[i+1].WinnerID})
+	}
+	return pairings
+}
+
+// roundRobinRound uses the circle method: the first player stays put and the
+// rest rotate one place per round. Colours alternate between rounds.
+func roundRobinRound(seeded []int64, round int) []pairing {
+	players := append([]int64(nil), seeded...)
+	if len(players)%2 == 1 {
+		players = append(players, 0)
+	}
+	n := len(players)
+	rotating := players[1:]
+	shift := (round - 1) % (n - 1)
+	rotated := append(append([]int64(nil), rotating[len(rotating)-shift:]...), rotating[:len(rotating)-shift]...)
+	circle := append([]int64{players[0]}, rotated...)
+
+	pairings := make([]pairing, 0, n/2)
+	for i := 0; i < n/2; i++ {
+		x, o := circle[i], circle[n-1-i]
+		if round%2 == 0 {
+			x, o = o, x
+		}
+		if x == 0 {
+			x, o = o, x
+		}
+		pairings = append(pairings, pairing{X: x, O: o})
+	}
+	return pairings
+}
+
+// swissRound pairs players by current standing, avoiding rematches where
+// possible. With an odd count the lowest-ranked player without a bye sits out.
+func swissRound(standings []tournamentStanding, matches []tournamentMatch) []pairing {
+	played := make(map[[2]int64]bool)
+	hadBye := make(map[int64]bool)
+	for _, match := range matches {
+		if match.PlayerOID == 0 {
+			hadBye[match.PlayerXID] = true
+			continue
+		}
+		played[[2]int64{match.PlayerXID, match.PlayerOID}] = true
+		played[[2]int64{match.PlayerOID, match.PlayerXID}] = true
+	}
+
+	ranked := make([]int64, len(standings))
+	for i, standing := range standings {
+		ranked[i] = standing.UserID
+	}
+
+	pairings := []pairing{}
+	if len(ranked)%2 == 1 {
+		bye := len(ranked) - 1
+		for i := len(ranked) - 1; i >= 0; i-- {
+			if !hadBye[ranked[i]] {
+				bye = i
+				break
+			}
+		}
+		pairings = append(pairings, pairing{X: ranked[bye]})
+		ranked = append(ranked[:bye:bye], ranked[bye+1:]...)
+	}
+
+	paired := make(map[int64]bool)
+	for i, player := range ranked {
+		if paired[player] {
+			continue
+		}
+		opponent := int64(0)
+		for _, candidate := range ranked[i+1:] {
+			if paired[candidate] {
+				continue
+			}
+			if opponent == 0 {
+				opponent = candidate
+			}
+			if !played[[2]int64{player, candidate}] {
+				opponent = candidate
+				break
+			}
+		}
+		paired[player], paired[opponent] = true, true
+		pairings = append(pairings, pairing{X: player, O: opponent})
+	}
+	return pairings
+}
+
+// computeStandings scores finished matches: a win or bye is worth 1 point and
+// a draw half. Ties break on Buchholz (opponents' points), then
+// Sonneborn-Berger (points of beaten opponents plus half of drawn ones), then
+// seed. In single elimination players still in the bracket rank first.
+func computeStandings(format string, players []tournamentPlayer, matches []tournamentMatch) []tournamentStanding {
+	byUser := make(map[int64]*tournamentStanding, len(players))
+	standings := make([]tournamentStanding, len(players))
+	seeds := make(map[int64]int, len(players))
+	for i, player := range players {
+		standings[i] = tournamentStanding{UserID: player.UserID, Name: player.Name}
+		byUser[player.UserID] = &standings[i]
+		seeds[player.UserID] = player.Seed
+	}
+
+	finished := []tournamentMatch{}
+	for _, match := range matches {
+		if match.Status != matchFinished {
+			continue
+		}
+		finished = append(finished, match)
+		x, o := byUser[match.PlayerXID], byUser[match.PlayerOID]
+		if x == nil {
+			continue
+		}
+		if o == nil {
+			x.Byes++
+			x.Points++
+			continue
+		}
+		x.Played++
+		o.Played++
+		switch match.WinnerID {
+		case 0:
+			x.Draws++
+			o.Draws++
+			x.Points += 0.5
+			o.Points += 0.5
+		case match.PlayerXID:
+			x.Wins++
+			o.Losses++
+			x.Points++
+			if format == formatSingleElimination {
+				o.Eliminated = true
+			}
+		default:
+			o.Wins++
+			x.Losses++
+			o.Points++
+			if format == formatSingleElimination {
+				x.Eliminated = true
+			}
+		}
+	}
+
+	for _, match := range finished {
+		x, o := byUser[match.PlayerXID], byUser[match.PlayerOID]
+		if x == nil || o == nil {
+			continue
+		}
+		x.Buchholz += o.Points
+		o.Buchholz += x.Points
+		switch match.WinnerID {
+		case 0:
+			x.SonnebornBerger += o.Points / 2
+			o.SonnebornBerger += x.Points / 2
+		case match.PlayerXID:
+			x.SonnebornBerger += o.Points
+		default:
+			o.SonnebornBerger += x.Points
+		}
+	}
+
+	sort.SliceStable(standings, func(i, j int) bool {
+		a, b := standings[i], standings[j]
+		if a.Eliminated != b.Eliminated {
+			return !a.Eliminated
+		}
+		if a.Points != b.Points {
+			return a.Points > b.Points
+		}
+		if a.Buchholz != b.Buchholz {
+			return a.Buchholz > b.Buchholz
+		}
+		if a.SonnebornBerger != b.SonnebornBerger {
+			return a.SonnebornBerger > b.SonnebornBerger
+		}
+		return seeds[a.UserID] < seeds[b.UserID]
+	})
+	for i := range standings {
+		standings[i].Rank = i + 1
+	}
+	return standings
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+// finishedMatch is a played match; a winner of 0 is a draw and an o of 0 a bye.
+func finishedMatch(x, o, winner int64) tournamentMatch {
+	return tournamentMatch{PlayerXID: x, PlayerOID: o, WinnerID: winner, IsDraw: o != 0 && winner == 0, Status: matchFinished}
+}
+
+// seededPlayers gives each user the seed of its position.
+func seededPlayers(ids ...int64) []tournamentPlayer {
+	players := make([]tournamentPlayer, len(ids))
+	for i, id := range ids {
+		players[i] = tournamentPlayer{UserID: id, Seed: i + 1}
+	}
+	return players
+}
+
+func standingOrder(standings []tournamentStanding) []int64 {
+	order := make([]int64, len(standings))
+	for i, standing := range standings {
+		order[i] = standing.UserID
+	}
+	return order
+}
+
+func TestTotalRounds(t *testing.T) {
+	tests := []struct {
+		format      string
+		players     int
+		swissRounds int
+		want        int
+	}{
+		{formatSingleElimination, 2, 0, 1},
+		{formatSingleElimination, 5, 0, 3},
+		{formatSingleElimination, 8, 0, 3},
+		{formatRoundRobin, 4, 0, 3},
+		{formatRoundRobin, 5, 0, 5},
+		{formatSwiss, 2, 0, 1},
+		{formatSwiss, 5, 0, 3},
+		{formatSwiss, 16, 0, 4},
+		{formatSwiss, 8, 5, 5},
+		{formatSwiss, 4, 10, 3},
+	}
+	for _, tt := range tests {
+		if got := totalRounds(tt.format, tt.players, tt.swissRounds); got != tt.want {
+			t.Errorf("totalRounds(%s, %d, %d) = %d, want %d", tt.format, tt.players, tt.swissRounds, got, tt.want)
+		}
+	}
+}
+
+func TestEliminationFirstRound(t *testing.T) {
+	tests := []struct {
+		seeded []int64
+		want   []pairing
+	}{
+		{[]int64{1, 2}, []pairing{{1, 2}}},
+		{[]int64{1, 2, 3}, []pairing{{1, 0}, {2, 3}}},
+		{[]int64{1, 2, 3, 4}, []pairing{{1, 4}, {2, 3}}},
+		{[]int64{1, 2, 3, 4, 5, 6, 7, 8}, []pairing{{1, 8}, {4, 5}, {2, 7}, {3, 6}}},
+		{[]int64{1, 2, 3, 4, 5}, []pairing{{1, 0}, {4, 5}, {2, 0}, {3, 0}}},
+	}
+	for _, tt := range tests {
+		if got := eliminationFirstRound(tt.seeded); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("eliminationFirstRound(%v) = %v, want %v", tt.seeded, got, tt.want)
+		}
+	}
+}
+
+func TestEliminationNextRound(t *testing.T) {
+	previous := []tournamentMatch{
+		finishedMatch(1, 8, 1),
+		finishedMatch(4, 5, 5),
+		finishedMatch(2, 7, 7),
+		finishedMatch(3, 6, 3),
+	}
+	want := []pairing{{1, 5}, {7, 3}}
+	if got := eliminationNextRound(previous); !reflect.DeepEqual(got, want) {
+		t.Fatalf("eliminationNextRound() = %v, want %v", got, want)
+	}
+}
+
+func TestRoundRobinRound(t *testing.T) {
+	for _, players := range []int{2, 4, 5, 6} {
+		seeded := make([]int64, players)
+		for i := range seeded {
+			seeded[i] = int64(i + 1)
+		}
+		met := make(map[[2]int64]int)
+		byes := make(map[int64]int)
+		rounds := totalRounds(formatRoundRobin, players, 0)
+		for round := 1; round <= rounds; round++ {
+			seen := make(map[int64]bool)
+			for _, p := range roundRobinRound(seeded, round) {
+				if p.X == 0 {
+					t.Fatalf("%d players, round %d: bye given to O: %v", players, round, p)
+				}
+				if seen[p.X] || (p.O != 0 && seen[p.O]) {
+					t.Fatalf("%d players, round %d: player paired twice in %v", players, round, p)
+				}
+				seen[p.X], seen[p.O] = true, true
+				if p.O == 0 {
+					byes[p.X]++
+					continue
+				}
+				met[[2]int64{min(p.X, p.O), max(p.X, p.O)}]++
+			}
+		}
+		for a := int64(1); a <= int64(players); a++ {
+			for b := a + 1; b <= int64(players); b++ {
+				if met[[2]int64{a, b}] != 1 {
+					t.Errorf("%d players: %d and %d met %d times, want once", players, a, b, met[[2]int64{a, b}])
+				}
+			}
+			if want := players % 2; byes[a] != want {
+				t.Errorf("%d players: %d had %d byes, want %d", players, a, byes[a], want)
+			}
+		}
+	}
+}
+
+func TestSwissRound(t *testing.T) {
+	tests := []struct {
+		name    string
+		ranked  []int64
+		matches []tournamentMatch
+		want    []pairing
+	}{
+		{
+			name:   "first round pairs by rank",
+			ranked: []int64{1, 2, 3, 4},
+			want:   []pairing{{1, 2}, {3, 4}},
+		},
+		{
+			name:    "avoids rematches",
+			ranked:  []int64{1, 2, 3, 4},
+			matches: []tournamentMatch{finishedMatch(1, 2, 1), finishedMatch(3, 4, 3)},
+			want:    []pairing{{1, 3}, {2, 4}},
+		},
+		{
+			name:    "rematch when nothing else is left",
+			ranked:  []int64{1, 2},
+			matches: []tournamentMatch{finishedMatch(1, 2, 1)},
+			want:    []pairing{{1, 2}},
+		},
+		{
+			name:   "lowest ranked player gets the bye",
+			ranked: []int64{1, 2, 3, 4, 5},
+			want:   []pairing{{5, 0}, {1, 2}, {3, 4}},
+		},
+		{
+			name:    "no second bye",
+			ranked:  []int64{1, 2, 3, 4, 5},
+			matches: []tournamentMatch{finishedMatch(5, 0, 5)},
+			want:    []pairing{{4, 0}, {1, 2}, {3, 5}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standings := make([]tournamentStanding, len(tt.ranked))
+			for i, id := range tt.ranked {
+				standings[i] = tournamentStanding{UserID: id}
+			}
+			if got := swissRound(standings, tt.matches); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("swissRound() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestComputeStandings(t *testing.T) {
+	tests := []struct {
+		name    string
+		format  string
+		players []tournamentPlayer
+		matches []tournamentMatch
+		want    []int64
+	}{
+		{
+			name:    "points first",
+			format:  formatSwiss,
+			players: seededPlayers(1, 2, 3),
+			matches: []tournamentMatch{finishedMatch(1, 2, 2), finishedMatch(3, 0, 3), finishedMatch(2, 3, 0)},
+			want:    []int64{2, 3, 1},
+		},
+		{
+			name:    "buchholz breaks a points tie",
+			format:  formatSwiss,
+			players: seededPlayers(2, 1, 3, 4),
+			matches: []tournamentMatch{
+				finishedMatch(1, 2, 1), finishedMatch(3, 4, 0),
+				finishedMatch(1, 3, 3), finishedMatch(2, 4, 2),
+			},
+			want: []int64{3, 1, 2, 4},
+		},
+		{
+			name:    "sonneborn-berger breaks a buchholz tie",
+			format:  formatSwiss,
+			players: seededPlayers(2, 1, 3, 4),
+			matches: []tournamentMatch{
+				finishedMatch(1, 3, 1), finishedMatch(2, 4, 2),
+				finishedMatch(1, 4, 4), finishedMatch(2, 3, 3),
+				finishedMatch(3, 0, 3),
+			},
+			want: []int64{3, 1, 2, 4},
+		},
+		{
+			name:    "seed breaks a full tie",
+			format:  formatSwiss,
+			players: seededPlayers(7, 3),
+			matches: []tournamentMatch{finishedMatch(3, 7, 0)},
+			want:    []int64{7, 3},
+		},
+		{
+			name:    "unfinished matches do not count",
+			format:  formatSwiss,
+			players: seededPlayers(1, 2),
+			matches: []tournamentMatch{{PlayerXID: 2, PlayerOID: 1, WinnerID: 2, Status: matchPlaying}},
+			want:    []int64{1, 2},
+		},
+		{
+			name:    "eliminated players rank last",
+			format:  formatSingleElimination,
+			players: seededPlayers(1, 2, 3, 4),
+			matches: []tournamentMatch{
+				finishedMatch(1, 4, 1), finishedMatch(2, 3, 3),
+				{PlayerXID: 1, PlayerOID: 3, Status: matchPlaying},
+			},
+			want: []int64{1, 3, 2, 4},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			standings := computeStandings(tt.format, tt.players, tt.matches)
+			if got := standingOrder(standings); !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("standings order = %v, want %v (%+v)", got, tt.want, standings)
+			}
+			for i, standing := range standings {
+				if standing.Rank != i+1 {
+					t.Fatalf("standing %d has rank %d", i, standing.Rank)
+				}
+			}
+		})
+	}
+}
+
+func TestComputeStandingsTieBreaks(t *testing.T) {
+	players := seededPlayers(1, 2, 3, 4)
+	matches := []tournamentMatch{
+		finishedMatch(1, 2, 1), finishedMatch(3, 4, 0),
+		finishedMatch(1, 3, 3), finishedMatch(2, 4, 2),
+	}
+	want := map[int64]tournamentStanding{
+		1: {Played: 2, Wins: 1, Losses: 1, Points: 1, Buchholz: 2.5, SonnebornBerger: 1},
+		2: {Played: 2, Wins: 1, Losses: 1, Points: 1, Buchholz: 1.5, SonnebornBerger: 0.5},
+		3: {Played: 2, Wins: 1, Draws: 1, Points: 1.5, Buchholz: 1.5, SonnebornBerger: 1.25},
+		4: {Played: 2, Draws: 1, Losses: 1, Points: 0.5, Buchholz: 2.5, SonnebornBerger: 0.75},
+	}
+	for _, got := range computeStandings(formatSwiss, players, matches) {
+		expected := want[got.UserID]
+		expected.UserID = got.UserID
+		expected.Rank = got.Rank
+		if got != expected {
+			t.Errorf("standing for %d = %+v, want %+v", got.UserID, got, expected)
+		}
+	}
+}
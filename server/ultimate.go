@@ -0,0 +1,62 @@
+package main
+
+import "errors"
+
+const (
+	ultimateBoards = 9
+	ultimateCells  = 9
+	noForcedBoard  = -1
+	subBoardDraw   = "draw"
+)
+
+// placeUltimateLocked plays symbol into cell of subBoard and sends the
+// opponent to the sub-board matching that cell, or anywhere if it is decided.
+// Under misère rules completing a line hands the sub-board to the opponent,
+// just as it loses the game on the meta-board.
+func (r *Room) placeUltimateLocked(symbol string, subBoard, cell int) error {
+	if r.forcedBoard != noForcedBoard && subBoard != r.forcedBoard {
+		return errors.New("must play in the forced sub-board")
+	}
+	if r.subWinners[subBoard] != "" {
+		return errors.New("sub-board already decided")
+	}
+
+	index := subBoard*ultimateCells + cell
+	if r.board[index] != "" {
+		return errors.New("cell already taken")
+	}
+	r.board[index] = symbol
+
+	sub := r.board[subBoard*ultimateCells : (subBoard+1)*ultimateCells]
+	if line := findWinner(sub, defaultBoardSize, defaultBoardSize, defaultBoardSize); line != "" {
+		r.subWinners[subBoard] = r.rules.winnerFromLine(line)
+	} else if boardFull(sub) {
+		r.subWinners[subBoard] = subBoardDraw
+	}
+
+	if r.subWinners[cell] == "" {
+		r.forcedBoard = cell
+	} else {
+		r.forcedBoard = noForcedBoard
+	}
+	return nil
+}
+
+func (r *Room) metaBoardLocked() []string {
+	meta := make([]string, ultimateBoards)
+	for i, winner := range r.subWinners {
+		if winner != subBoardDraw {
+			meta[i] = winner
+		}
+	}
+	return meta
+}
+
+func (r *Room) allSubBoardsDecidedLocked() bool {
+	for _, winner := range r.subWinners {
+		if winner == "" {
+			return false
+		}
+	}
+	return true
+}
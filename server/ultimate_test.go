@@ -0,0 +1,73 @@
+package main
+
+import "testing"
+
+func newUltimateRoom(misere bool) *Room {
+	rules, _ := newGameRules(variantUltimate, 0, 0, 0)
+	rules.Misere = misere
+	room := &Room{rules: rules}
+	room.resetBoardLocked()
+	return room
+}
+
+func TestPlaceUltimateDecidesSubBoard(t *testing.T) {
+	tests := []struct {
+		name   string
+		misere bool
+		want   string
+	}{
+		{"line wins the sub-board", false, symbolX},
+		{"misere line gives it away", true, symbolO},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			room := newUltimateRoom(tt.misere)
+			room.board[0], room.board[1] = symbolX, symbolX
+			if err := room.placeUltimateLocked(symbolX, 0, 2); err != nil {
+				t.Fatalf("placeUltimateLocked: %v", err)
+			}
+			if room.subWinners[0] != tt.want {
+				t.Fatalf("sub-board 0 went to %q, want %q", room.subWinners[0], tt.want)
+			}
+			if room.forcedBoard != 2 {
+				t.Fatalf("forced board = %d, want 2", room.forcedBoard)
+			}
+		})
+	}
+}
+
+func TestPlaceUltimateForcedBoard(t *testing.T) {
+	room := newUltimateRoom(false)
+	if err := room.placeUltimateLocked(symbolX, 4, 0); err != nil {
+		t.Fatalf("first move: %v", err)
+	}
+	if err := room.placeUltimateLocked(symbolO, 3, 0); err == nil {
+		t.Fatal("move outside the forced sub-board was accepted")
+	}
+
+	room.subWinners[4] = symbolX
+	if err := room.placeUltimateLocked(symbolO, 0, 4); err != nil {
+		t.Fatalf("forced move: %v", err)
+	}
+	if room.forcedBoard != noForcedBoard {
+		t.Fatalf("forced board = %d after sending to a decided sub-board, want none", room.forcedBoard)
+	}
+	if err := room.placeUltimateLocked(symbolX, 4, 8); err == nil {
+		t.Fatal("move in a decided sub-board was accepted")
+	}
+}
+
+func TestUltimateMetaWinner(t *testing.T) {
+	for _, misere := range []bool{false, true} {
+		room := newUltimateRoom(misere)
+		room.subWinners[0], room.subWinners[4], room.subWinners[8] = symbolX, symbolX, symbolX
+		room.subWinners[1] = subBoardDraw
+		want := symbolX
+		if misere {
+			want = symbolO
+		}
+		if got := room.checkWinner(); got != want {
+			t.Errorf("checkWinner() with misere=%v = %q, want %q", misere, got, want)
+		}
+	}
+}
@@ -1,18 +1,28 @@
 import { reactive, computed } from 'vue';
 import { apiUrl } from './api';
 
+export type OAuthProvider = 'discord' | 'github' | 'google';
+
+type Identity = {
+  provider: OAuthProvider;
+  username: string;
+  avatar?: string;
+};
+
 type AuthUser = {
   id: number;
   discord_id?: string;
   username: string;
   avatar?: string;
   is_guest?: boolean;
+  identities?: Identity[];
 };
 
 type AuthState = {
   user: AuthUser | null;
   accessToken: string | null;
   status: 'idle' | 'loading' | 'ready';
+  providers: OAuthProvider[];
 };
 
 type RefreshResponse = {
@@ -27,26 +37,66 @@ type TicketResponse = {
   expires_in: number;
 };
 
-const guestIdKey = 'ttt_guest_id';
+type GuestResponse = {
+  guest_token: string;
+};
+
+type ProvidersResponse = {
+  providers: OAuthProvider[];
+};
+
+const guestTokenKey = 'ttt_guest_token';
+const legacyGuestIdKey = 'ttt_guest_id';
 
 const state = reactive<AuthState>({
   user: null,
   accessToken: null,
   status: 'idle',
+  providers: [],
 });
 
-const getOrCreateGuestId = (): string => {
-  const stored = localStorage.getItem(guestIdKey);
-  if (stored && stored.length > 0) {
-    return stored;
+let guestToken: string | null = localStorage.getItem(guestTokenKey);
+let pendingGuestToken: Promise<string | null> | null = null;
+
+const requestGuestToken = (legacyGuestId: string | null): Promise<Response> =>
+  fetch(apiUrl('/auth/guest'), {
+    method: 'POST',
+    headers: { 'Content-Type': 'application/json' },
+    body: JSON.stringify(legacyGuestId ? { legacy_guest_id: legacyGuestId } : {}),
+  });
+
+// ensureGuestToken fetches a signed guest token once. An id generated by an
+// older version of the app is sent along so its history is kept.
+const ensureGuestToken = async (): Promise<string | null> => {
+  if (guestToken) {
+    return guestToken;
+  }
+  if (!pendingGuestToken) {
+    pendingGuestToken = (async () => {
+      try {
+        const legacyGuestId = localStorage.getItem(legacyGuestIdKey);
+        let response = await requestGuestToken(legacyGuestId);
+        if (response.status === 409) {
+          response = await requestGuestToken(null);
+        }
+        if (!response.ok) {
+          return null;
+        }
+        const data = (await response.json()) as GuestResponse;
+        guestToken = data.guest_token;
+        localStorage.setItem(guestTokenKey, guestToken);
+        localStorage.removeItem(legacyGuestIdKey);
+        return guestToken;
+      } catch (error) {
+        return null;
+      } finally {
+        pendingGuestToken = null;
+      }
+    })();
   }
-  const generated = crypto.randomUUID ? crypto.randomUUID() : `${Date.now()}-${Math.random().toString(16).slice(2)}`;
-  localStorage.setItem(guestIdKey, generated);
-  return generated;
+  return pendingGuestToken;
 };
 
-const guestId = getOrCreateGuestId();
-
 const isAuthenticated = computed(() => Boolean(state.user));
 
 const applySession = (payload: RefreshResponse): void => {
@@ -59,7 +109,7 @@ const clearSession = (): void => {
   state.accessToken = null;
 };
 
-const refreshSession = async (): Promise<void> => {
+const doRefresh = async (): Promise<void> => {
   state.status = 'loading';
   try {
     const response = await fetch(apiUrl('/auth/refresh'), {
@@ -82,6 +132,20 @@ const refreshSession = async (): Promise<void> => {
   }
 };
 
+let pendingRefresh: Promise<void> | null = null;
+
+// refreshSession shares one in-flight request; the server rotates the refresh
+// token on every call and treats stale tokens outside a short grace window as
+// stolen.
+const refreshSession = (): Promise<void> => {
+  if (!pendingRefresh) {
+    pendingRefresh = doRefresh().finally(() => {
+      pendingRefresh = null;
+    });
+  }
+  return pendingRefresh;
+};
+
 const ensureAccessToken = async (): Promise<string | null> => {
   if (state.accessToken) {
     return state.accessToken;
@@ -90,9 +154,24 @@ const ensureAccessToken = async (): Promise<string | null> => {
   return state.accessToken;
 };
 
-const loginWithDiscord = (): void => {
+const loadProviders = async (): Promise<void> => {
+  try {
+    const response = await fetch(apiUrl('/auth/providers'));
+    if (!response.ok) {
+      return;
+    }
+    const data = (await response.json()) as ProvidersResponse;
+    state.providers = data.providers;
+  } catch {
+    state.providers = [];
+  }
+};
+
+const loginWith = async (provider: OAuthProvider): Promise<void> => {
   const returnTo = `${window.location.pathname}${window.location.search}${window.location.hash}`;
-  const url = `${apiUrl('/auth/discord/login')}?return_to=${encodeURIComponent(returnTo)}&guest_id=${encodeURIComponent(guestId)}`;
+  const token = await ensureGuestToken();
+  const guestParam = token ? `&guest_id=${encodeURIComponent(token)}` : '';
+  const url = `${apiUrl(`/auth/${provider}/login`)}?return_to=${encodeURIComponent(returnTo)}${guestParam}`;
   window.location.assign(url);
 };
 
@@ -129,9 +208,10 @@ const getWsTicket = async (): Promise<string | null> => {
 export const useAuth = () => ({
   state,
   isAuthenticated,
-  guestId,
+  ensureGuestToken,
   refreshSession,
-  loginWithDiscord,
+  loadProviders,
+  loginWith,
   logout,
   getWsTicket,
 });
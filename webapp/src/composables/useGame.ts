@@ -21,6 +21,7 @@ type GameState = {
 type RoomResponsePayload = {
   room_code?: string;
   player_id?: string;
+  reconnect_token?: string;
   symbol?: string;
   role?: string;
   state?: unknown;
@@ -59,6 +60,7 @@ const state = reactive({
   connectionStatus: 'disconnected' as ConnectionStatus,
   roomCode: null as string | null,
   playerId: null as string | null,
+  reconnectToken: null as string | null,
   symbol: null as string | null,
   role: null as string | null,
   errorMessage: null as string | null,
@@ -161,6 +163,7 @@ const normalizeState = (payload: Record<string, unknown>): GameState => {
 const applyRoomResponse = (payload: RoomResponsePayload): void => {
   state.roomCode = payload.room_code ?? state.roomCode;
   state.playerId = payload.player_id ?? state.playerId;
+  state.reconnectToken = payload.reconnect_token ?? state.reconnectToken;
   const incomingSymbol = payload.symbol;
   if (incomingSymbol) {
     state.symbol = incomingSymbol;
@@ -218,7 +221,8 @@ const createRoom = async (name: string): Promise<void> => {
   state.roomClosedReason = null;
   state.errorMessage = null;
   await ensureConnected();
-  send('create_room', { name, guest_id: auth.guestId });
+  const guestToken = await auth.ensureGuestToken();
+  send('create_room', { name, guest_id: guestToken ?? undefined });
 };
 
 const joinRoom = async (code: string, name: string, spectator = false): Promise<void> => {
@@ -226,7 +230,8 @@ const joinRoom = async (code: string, name: string, spectator = false): Promise<
   state.roomClosedReason = null;
   state.errorMessage = null;
   await ensureConnected();
-  send('join_room', { room_code: code.toUpperCase(), name, spectator, guest_id: auth.guestId });
+  const guestToken = await auth.ensureGuestToken();
+  send('join_room', { room_code: code.toUpperCase(), name, spectator, guest_id: guestToken ?? undefined });
 };
 
 const reconnect = async (): Promise<void> => {
@@ -238,11 +243,13 @@ const reconnect = async (): Promise<void> => {
   state.roomClosedReason = null;
   state.errorMessage = null;
   await ensureConnected(true);
+  const guestToken = await auth.ensureGuestToken();
   send('join_room', {
     room_code: state.roomCode,
     player_id: state.playerId,
+    reconnect_token: state.reconnectToken ?? undefined,
     spectator: isSpectator.value,
-    guest_id: auth.guestId,
+    guest_id: guestToken ?? undefined,
   });
 };
 
@@ -253,7 +260,7 @@ const sendMove = (cell: number): void => {
   if (isSpectator.value || !isConnected.value) {
     return;
   }
-  send('move', { room_code: state.roomCode, player_id: state.playerId, cell });
+  send('move', { room_code: state.roomCode, cell });
 };
 
 const requestRematch = (): void => {
@@ -263,7 +270,7 @@ const requestRematch = (): void => {
   if (isSpectator.value || !isConnected.value) {
     return;
   }
-  send('rematch', { room_code: state.roomCode, player_id: state.playerId });
+  send('rematch', { room_code: state.roomCode });
 };
 
 const leaveRoom = (): void => {
@@ -271,6 +278,7 @@ const leaveRoom = (): void => {
   closeSocket();
   state.roomCode = null;
   state.playerId = null;
+  state.reconnectToken = null;
   state.symbol = null;
   state.role = null;
   state.gameState = null;